@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// archiveSep separates the path of a tar or zip archive from the name of one
+// of its entries in the path given to a dat file stored in an archive.
+const archiveSep = "!"
+
+var archiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".zip"}
+
+func isArchive(p string) bool {
+	for _, s := range archiveSuffixes {
+		if strings.HasSuffix(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchive splits p into the path of an archive and the name of an
+// entry in this archive.
+func splitArchive(p string) (string, string, bool) {
+	for _, s := range archiveSuffixes {
+		if ix := strings.Index(p, s+archiveSep); ix >= 0 {
+			ix += len(s)
+			return p[:ix], p[ix+len(archiveSep):], true
+		}
+	}
+	return p, "", false
+}
+
+// entryName gives the path of a dat file without the archive containing it.
+func entryName(p string) string {
+	if _, e, ok := splitArchive(p); ok {
+		return e
+	}
+	return p
+}
+
+// expandArchives replaces the archives found in ps by the list of their
+// entries.
+func expandArchives(ps []string) ([]string, error) {
+	var xs []string
+	for _, p := range ps {
+		if !isArchive(p) {
+			xs = append(xs, p)
+			continue
+		}
+		es, err := listArchive(p)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, es...)
+	}
+	return xs, nil
+}
+
+type archiveIndex struct {
+	order map[string]int
+	infos map[string]os.FileInfo
+}
+
+var archives = make(map[string]*archiveIndex)
+
+func indexArchive(p string) (*archiveIndex, error) {
+	if x, ok := archives[p]; ok {
+		return x, nil
+	}
+	x := archiveIndex{
+		order: make(map[string]int),
+		infos: make(map[string]os.FileInfo),
+	}
+	if strings.HasSuffix(p, ".zip") {
+		z, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		for i, f := range z.File {
+			if f.Mode().IsRegular() {
+				x.order[f.Name], x.infos[f.Name] = i, f.FileInfo()
+			}
+		}
+	} else {
+		t, err := openTar(p)
+		if err != nil {
+			return nil, err
+		}
+		defer t.Close()
+		for i := 0; ; i++ {
+			h, err := t.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", p, err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				x.order[h.Name], x.infos[h.Name] = i, h.FileInfo()
+			}
+		}
+	}
+	archives[p] = &x
+	return &x, nil
+}
+
+// listArchive gives the sorted list of the regular files found in the archive.
+func listArchive(p string) ([]string, error) {
+	x, err := indexArchive(p)
+	if err != nil {
+		return nil, err
+	}
+	var es []string
+	for e := range x.order {
+		es = append(es, p+archiveSep+e)
+	}
+	sort.Strings(es)
+	return es, nil
+}
+
+func statEntry(p string) (os.FileInfo, error) {
+	a, e, _ := splitArchive(p)
+	x, err := indexArchive(a)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := x.infos[e]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	return i, nil
+}
+
+// tarCursor is a tar archive opened for reading. It is kept open between
+// two entries so that entries read following the order of the archive do not
+// require to read the archive from its beginning each time.
+type tarCursor struct {
+	*tar.Reader
+	file  *os.File
+	zip   *gzip.Reader
+	path  string
+	index int
+	busy  bool
+}
+
+func openTar(p string) (*tarCursor, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	t := tarCursor{file: f, path: p, index: -1}
+	var r io.Reader = f
+	if !strings.HasSuffix(p, ".tar") {
+		if t.zip, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		r = t.zip
+	}
+	t.Reader = tar.NewReader(r)
+	return &t, nil
+}
+
+func (t *tarCursor) Next() (*tar.Header, error) {
+	t.index++
+	return t.Reader.Next()
+}
+
+func (t *tarCursor) Close() error {
+	if t.zip != nil {
+		t.zip.Close()
+	}
+	return t.file.Close()
+}
+
+var cursor *tarCursor
+
+// entryFile is a dat file read from an archive.
+type entryFile struct {
+	io.Reader
+	name  string
+	info  os.FileInfo
+	close func() error
+}
+
+func (e *entryFile) Name() string               { return e.name }
+func (e *entryFile) Stat() (os.FileInfo, error) { return e.info, nil }
+func (e *entryFile) Close() error               { return e.close() }
+
+func openEntry(p string) (rawFile, error) {
+	a, e, _ := splitArchive(p)
+	x, err := indexArchive(a)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := x.order[e]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	f := entryFile{name: p, info: x.infos[e]}
+	if strings.HasSuffix(a, ".zip") {
+		z, err := zip.OpenReader(a)
+		if err != nil {
+			return nil, err
+		}
+		r, err := z.File[index].Open()
+		if err != nil {
+			z.Close()
+			return nil, err
+		}
+		f.Reader = r
+		f.close = func() error {
+			r.Close()
+			return z.Close()
+		}
+		return &f, nil
+	}
+
+	t := cursor
+	switch {
+	case t != nil && t.busy:
+		// the shared cursor is used by another entry (eg: dat file checksumed
+		// for the metadata while the next one is being read)
+		if t, err = openTar(a); err != nil {
+			return nil, err
+		}
+		f.close = t.Close
+	case t == nil || t.path != a || t.index >= index:
+		if t != nil {
+			t.Close()
+		}
+		if t, err = openTar(a); err != nil {
+			return nil, err
+		}
+		cursor = t
+		fallthrough
+	default:
+		t.busy = true
+		f.close = func() error {
+			t.busy = false
+			return nil
+		}
+	}
+	for t.index < index {
+		if _, err := t.Next(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+	}
+	f.Reader = t
+	return &f, nil
+}
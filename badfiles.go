@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	badExtension = "extension"
+	badMagic     = "bad magic"
+	badRead      = "read error"
+)
+
+var errBadMagic = errors.New("bad magic")
+
+// badFile is a dat file flagged as bad in the archive (.bad extension) or
+// that could not be read.
+type badFile struct {
+	Path     string `xml:",chardata"`
+	Size     int64  `xml:"size,attr"`
+	Reason   string `xml:"reason,attr"`
+	Error    string `xml:"error,attr,omitempty"`
+	Included bool   `xml:"included,attr"`
+}
+
+func newBadFile(p, reason string, err error) badFile {
+	b := badFile{Path: p, Reason: reason}
+	if err != nil {
+		b.Error = err.Error()
+	}
+	if i, err := statRaw(p); err == nil {
+		b.Size = i.Size()
+	}
+	return b
+}
+
+func isBad(p string) bool {
+	return strings.HasSuffix(p, ".bad")
+}
+
+// openNext opens the next dat file that can be read. Files that can not be
+// opened are recorded as bad files and skipped.
+func (f *fileReader) openNext() error {
+	for len(f.ps) > 0 {
+		p := f.ps[0]
+		f.ps = f.ps[1:]
+
+		var (
+			r   *sourceFile
+			err error
+		)
+		f.from, f.merged, f.block = nil, nil, 0
+		if others, ok := f.pairs[p]; ok {
+			r, f.from, err = openMerged(p, others)
+			if err == nil {
+				f.merged = append([]string{p}, others...)
+				for _, o := range others {
+					if isBad(o) {
+						f.Bad = append(f.Bad, newBadFile(o, badExtension, nil))
+						f.Bad[len(f.Bad)-1].Included = true
+					}
+				}
+			}
+		} else {
+			r, err = openFile(p)
+		}
+		if err == nil {
+			if isBad(p) {
+				f.Bad = append(f.Bad, newBadFile(p, badExtension, nil))
+				f.Bad[len(f.Bad)-1].Included = true
+			}
+			f.file = r
+			slog.Debug("reading dat file", "file", p)
+			journal.Event(journalOpen, p)
+			return nil
+		}
+		reason := badRead
+		if errors.Is(err, errBadMagic) {
+			reason = badMagic
+		}
+		slog.Warn("file skipped", "file", p, "reason", reason, "err", err)
+		f.Bad = append(f.Bad, newBadFile(p, reason, err))
+		journal.Record(journalEntry{Event: journalSkip, File: p, Error: err.Error()})
+		quarantine(p, reason, err)
+	}
+	f.file = nil
+	return nil
+}
+
+// Skipped gives the number of bad files not used.
+func (f *fileReader) Skipped() int {
+	var n int
+	for _, b := range f.Bad {
+		if !b.Included {
+			n++
+		}
+	}
+	return n
+}
+
+// reportBadFiles logs a summary of the bad files found during the run and,
+// if file is not empty, writes the list of these files in it.
+func reportBadFiles(bad []badFile, file string) error {
+	var skipped, included int
+	for _, b := range bad {
+		if b.Included {
+			included++
+		} else {
+			skipped++
+		}
+	}
+	if len(bad) > 0 {
+		slog.Warn("bad files", "skipped", skipped, "included", included)
+	}
+	if file == "" {
+		return nil
+	}
+	c := struct {
+		XMLName  xml.Name  `xml:"bad-files"`
+		Skipped  int       `xml:"skipped,attr"`
+		Included int       `xml:"included,attr"`
+		Files    []badFile `xml:"file"`
+	}{
+		Skipped:  skipped,
+		Included: included,
+		Files:    bad,
+	}
+	w, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(&c); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// runBench implements the bench command: it builds in memory a stream of
+// blocks holding synthetic listing files and measures, for each buffer
+// size, the throughput of the parsing of the blocks alone and of the full
+// conversion (listing files written to a storage discarding them). The best
+// of several runs is kept to limit the noise.
+func runBench(args []string) error {
+	set := flag.NewFlagSet("bench", flag.ExitOnError)
+	blocks := set.Int("blocks", 1000000, "")
+	per := set.Int("listing", 10000, "")
+	buffers := set.String("buffers", "4K,64K,1M", "")
+	text := set.Bool("text", false, "")
+	runs := set.Int("runs", 3, "")
+	set.BoolVar(&rawBytes, "bytes", false, "")
+	set.Usage = flag.Usage
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() != 0 {
+		flag.Usage()
+	}
+	switch {
+	case *blocks <= 0 || *per <= 0 || *per >= counterLimit:
+		return fmt.Errorf("invalid number of blocks: %d/%d", *blocks, *per)
+	case *runs <= 0:
+		return fmt.Errorf("invalid number of runs: %d", *runs)
+	}
+	var sizes []int
+	for _, str := range strings.Split(*buffers, ",") {
+		n, err := parseSize(str)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, int(n))
+	}
+	// the listing files created are not worth a log line each
+	setupLogger("warn", "text")
+
+	stream := benchStream(*blocks, *per)
+	fmt.Printf("%d blocks (%d listing files, %s)\n", *blocks, (*blocks+*per-1) / *per, formatSize(int64(len(stream))))
+	fmt.Printf("%-12s %14s %14s %14s %14s\n", "buffer", "parse MiB/s", "parse blocks/s", "convert MiB/s", "convert blocks/s")
+	for _, size := range sizes {
+		var parse, convert time.Duration
+		for i := 0; i < *runs; i++ {
+			d, err := benchParse(stream, size)
+			if err != nil {
+				return err
+			}
+			if i == 0 || d < parse {
+				parse = d
+			}
+			opts := options{
+				store:       discardStorage{},
+				total:       new(quality),
+				text:        *text,
+				writeBuffer: size,
+			}
+			now := time.Now()
+			if err := dumpFiles(bufio.NewReaderSize(bytes.NewReader(stream), size), "", opts); err != nil {
+				return err
+			}
+			if d := time.Since(now); i == 0 || d < convert {
+				convert = d
+			}
+		}
+		fmt.Printf("%-12s %14.1f %14.0f %14.1f %14.0f\n", formatSize(int64(size)),
+			float64(len(stream))/parse.Seconds()/(1<<20), float64(*blocks)/parse.Seconds(),
+			float64(len(stream))/convert.Seconds()/(1<<20), float64(*blocks)/convert.Seconds())
+	}
+	return nil
+}
+
+// benchStream gives a stream of n blocks split in listing files of per
+// blocks, each one starting with its FileFlag block.
+func benchStream(n, per int) []byte {
+	var (
+		buf     bytes.Buffer
+		payload = LineSize - 2
+		bs      = make([]byte, LineSize)
+	)
+	for i := 0; i < n; i += per {
+		count := min(per, n-i)
+		clear(bs)
+		binary.BigEndian.PutUint16(bs, FileFlag)
+		binary.BigEndian.PutUint32(bs[2:], uint32(count*payload))
+		copy(bs[6:], fmt.Sprintf("bench_%06d.txt", i/per))
+		buf.Write(bs)
+		for j := 0; j < count; j++ {
+			clear(bs)
+			binary.BigEndian.PutUint16(bs, uint16(j+1))
+			copy(bs[2:], fmt.Sprintf("line %05d hello world\n", j+1))
+			buf.Write(bs)
+		}
+	}
+	return buf.Bytes()
+}
+
+// benchParse reads all the blocks of stream through a buffer of the given
+// size.
+func benchParse(stream []byte, size int) (time.Duration, error) {
+	var (
+		r   = bufio.NewReaderSize(bytes.NewReader(stream), size)
+		buf = make([]byte, LineSize)
+		now = time.Now()
+	)
+	for {
+		if _, err := nextBlock(r, buf); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(now), nil
+}
+
+// discardStorage is the storage of the bench command: listing files are
+// converted and written but their content is dropped.
+type discardStorage struct{}
+
+func (discardStorage) Create(string) (io.WriteCloser, error) {
+	return nopCloser{io.Discard}, nil
+}
+
+func (discardStorage) Remove(string) error {
+	return nil
+}
+
+func (discardStorage) Exists(string) bool {
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Block is a whole frame of LineSize bytes read from the dat files: a
+// sequence counter (or a flag) followed by the payload.
+type Block struct {
+	raw []byte
+}
+
+// parseBlock gives the block framed by bs. bs is not copied: the block is
+// only valid as long as bs is not modified.
+func parseBlock(bs []byte) (Block, error) {
+	if len(bs) != LineSize {
+		return Block{}, fmt.Errorf("invalid block: %d bytes instead of %d", len(bs), LineSize)
+	}
+	return Block{raw: bs}, nil
+}
+
+// Bytes gives the whole frame of the block.
+func (b Block) Bytes() []byte {
+	return b.raw
+}
+
+// Sequence gives the sequence counter of the block (or its flag for
+// FileFlag and MilFlag blocks).
+func (b Block) Sequence() uint16 {
+	return binary.BigEndian.Uint16(b.raw)
+}
+
+// IsFileHeader reports whether the block announces a new listing file.
+func (b Block) IsFileHeader() bool {
+	return b.Sequence() == FileFlag
+}
+
+// IsFill reports whether the block is a fill block.
+func (b Block) IsFill() bool {
+	return b.Sequence() == MilFlag
+}
+
+// Payload gives the bytes of the block to write in the listing file.
+func (b Block) Payload() []byte {
+	return dec.Payload(b.raw)
+}
+
+// File gives the name and the size of the listing file announced by a
+// FileFlag block.
+func (b Block) File() (string, int) {
+	if !b.IsFileHeader() {
+		return "", 0
+	}
+	return dec.File(b.raw)
+}
+
+// blockReader is implemented by the readers able to give the blocks one by
+// one instead of a stream of bytes.
+type blockReader interface {
+	ReadBlock() (Block, error)
+}
+
+// nextBlock gives the next block of r. Readers giving whole blocks are used
+// directly so that a block never spans two dat files. body is the buffer
+// used to read the blocks of the other readers.
+func nextBlock(r io.Reader, body []byte) (Block, error) {
+	if b, ok := r.(blockReader); ok {
+		return b.ReadBlock()
+	}
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Block{}, err
+	}
+	return parseBlock(body)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func testBlock(seq uint16) []byte {
+	bs := make([]byte, LineSize)
+	binary.BigEndian.PutUint16(bs, seq)
+	return bs
+}
+
+func TestParseBlock(t *testing.T) {
+	data := []struct {
+		Name   string
+		Bytes  []byte
+		Seq    uint16
+		Header bool
+		Fill   bool
+	}{
+		{Name: "first", Bytes: testBlock(0), Seq: 0},
+		{Name: "counter", Bytes: testBlock(1234), Seq: 1234},
+		{Name: "last", Bytes: testBlock(counterMask), Seq: counterMask},
+		{Name: "fileflag", Bytes: testBlock(FileFlag), Seq: FileFlag, Header: true},
+		{Name: "milflag", Bytes: testBlock(MilFlag), Seq: MilFlag, Fill: true},
+	}
+	for _, d := range data {
+		b, err := parseBlock(d.Bytes)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+			continue
+		}
+		if s := b.Sequence(); s != d.Seq {
+			t.Errorf("%s: sequence mismatch: want %d, got %d", d.Name, d.Seq, s)
+		}
+		if h := b.IsFileHeader(); h != d.Header {
+			t.Errorf("%s: file header mismatch: want %t, got %t", d.Name, d.Header, h)
+		}
+		if f := b.IsFill(); f != d.Fill {
+			t.Errorf("%s: fill mismatch: want %t, got %t", d.Name, d.Fill, f)
+		}
+	}
+}
+
+func TestParseBlockShort(t *testing.T) {
+	data := []struct {
+		Name  string
+		Bytes []byte
+	}{
+		{Name: "empty", Bytes: nil},
+		{Name: "counter only", Bytes: testBlock(1)[:2]},
+		{Name: "short", Bytes: testBlock(1)[:LineSize-1]},
+		{Name: "long", Bytes: append(testBlock(1), 0)},
+	}
+	for _, d := range data {
+		if _, err := parseBlock(d.Bytes); err == nil {
+			t.Errorf("%s: expected error for %d bytes", d.Name, len(d.Bytes))
+		}
+	}
+}
+
+func TestBlockCounterMask(t *testing.T) {
+	data := []struct {
+		Name  string
+		Seq   uint16
+		Want  uint16
+		Valid bool
+	}{
+		{Name: "last", Seq: counterMask, Want: counterMask, Valid: true},
+		{Name: "wrapped", Seq: counterLimit | 5, Want: 5},
+		{Name: "fileflag", Seq: FileFlag, Want: counterMask, Valid: true},
+		{Name: "milflag", Seq: MilFlag, Want: counterMask - 1, Valid: true},
+	}
+	for _, d := range data {
+		if s := d.Seq & counterMask; s != d.Want {
+			t.Errorf("%s: masked counter mismatch: want %d, got %d", d.Name, d.Want, s)
+		}
+		if v := validCounter(d.Seq); v != d.Valid {
+			t.Errorf("%s: valid counter mismatch: want %t, got %t", d.Name, d.Valid, v)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// catalogue gathers the metadata of all the listing files created during the
+// run in one document (-catalogue), written as XML or JSON according to the
+// extension of its file.
+type catalogue struct {
+	mu   sync.Mutex
+	file string
+
+	XMLName xml.Name    `xml:"catalogue" json:"-"`
+	Program string      `xml:"program,attr" json:"program"`
+	Version string      `xml:"version,attr" json:"version"`
+	Start   time.Time   `xml:"start" json:"start"`
+	End     time.Time   `xml:"end" json:"end"`
+	Files   []*metadata `xml:"mvis" json:"files"`
+}
+
+func newCatalogue(file string) (*catalogue, error) {
+	switch filepath.Ext(file) {
+	case ".xml", ".json":
+	default:
+		return nil, fmt.Errorf("%s: catalogue should be a .xml or .json file", file)
+	}
+	c := catalogue{
+		file:    file,
+		Program: Program,
+		Version: Version,
+		Start:   time.Now(),
+		Files:   []*metadata{},
+	}
+	return &c, nil
+}
+
+// Add records the metadata of the listing file m once closed.
+func (c *catalogue) Add(m *mvis) error {
+	if c == nil {
+		return nil
+	}
+	meta, err := m.Metadata()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Files = append(c.Files, meta)
+	return nil
+}
+
+func (c *catalogue) WriteFile() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.End = time.Now()
+	w, err := os.Create(c.file)
+	if err != nil {
+		return err
+	}
+	if err := c.encode(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *catalogue) encode(w io.Writer) error {
+	if filepath.Ext(c.file) == ".json" {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(c); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
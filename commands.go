@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// command is a subcommand of mvis2list. Except serve and diff that have
+// their own flags, commands are built on the flags of the legacy interface:
+// they set the flags of their mode and only accept the flags relevant to
+// them.
+type command struct {
+	Name  string
+	Args  string
+	Short string
+	// flags set by the command
+	Mode []string
+	// flags accepted by the command (all of them when empty) and flags
+	// refused when all the others are accepted
+	Flags   []string
+	Exclude []string
+
+	Run func([]string)
+}
+
+// inputFlags are the flags selecting and decoding the dat files.
+var inputFlags = []string{
+	"config", "log-level", "log-format", "quiet", "v", "vv", "bytes",
+	"keep", "keep-fill", "salvage", "merge", "pick", "stdin",
+	"instrument", "fcc", "header-len", "line-size", "scan-header", "no-header",
+	"read-buffer", "max-memory", "rate", "prefetch", "bad-report", "quarantine", "retry", "retry-wait", "progress", "strict",
+	"validate", "text-upi",
+}
+
+// modeFlags are the flags replaced by commands.
+var modeFlags = []string{
+	"list", "dump", "report", "verify", "batch", "watch", "watch-interval",
+	"incremental", "no-upi-dir", "channel", "include-partial", "diff", "grep", "show-groups",
+}
+
+var commands = []command{
+	{
+		Name:    "convert",
+		Args:    "<list of dat files>",
+		Short:   "convert dat files to listing files (same as without command)",
+		Exclude: modeFlags,
+	},
+	{
+		Name:  "list",
+		Args:  "<list of dat files>",
+		Short: "print the list of blocks of dat files",
+		Mode:  []string{"list"},
+		Flags: append([]string{"dump", "grep", "show-groups"}, inputFlags...),
+	},
+	{
+		Name:  "report",
+		Args:  "<list of dat files>",
+		Short: "print a report on available blocks",
+		Mode:  []string{"report"},
+		Flags: append([]string{"grep"}, inputFlags...),
+	},
+	{
+		Name:    "verify",
+		Args:    "<list of dat files>",
+		Short:   "compare the listing files that would be created with the existing ones",
+		Mode:    []string{"verify"},
+		Exclude: modeFlags,
+	},
+	{
+		Name:    "batch",
+		Args:    "<archive[,archive...]> <UPI list>",
+		Short:   "convert the dat files of a list of UPI found in the archive",
+		Mode:    []string{"batch"},
+		Exclude: []string{"list", "dump", "report", "verify", "diff", "grep"},
+	},
+	{
+		Name:  "serve",
+		Short: "run an HTTP server accepting conversion jobs (see Daemon mode)",
+		Run: func(args []string) {
+			if err := runServe(args); err != nil {
+				fatal(err)
+			}
+		},
+	},
+	{
+		Name:  "gen",
+		Short: "create synthetic dat files for tests (see Test data)",
+		Run: func(args []string) {
+			if err := runGen(args); err != nil {
+				fatal(err)
+			}
+		},
+	},
+	{
+		Name:  "bench",
+		Short: "measure the throughput of the conversion (see Benchmark)",
+		Run: func(args []string) {
+			if err := runBench(args); err != nil {
+				fatal(err)
+			}
+		},
+	},
+	{
+		Name:  "diff",
+		Short: "compare two listing files (see Listing diff)",
+		Run: func(args []string) {
+			exitDiff(runDiff(args))
+		},
+	},
+}
+
+// findCommand gives the command named by the first argument of args and the
+// remaining arguments. The command is nil when args start with a flag or a
+// file (legacy interface).
+func findCommand(args []string) (*command, []string) {
+	if len(args) == 0 {
+		return nil, args
+	}
+	if args[0] == "help" {
+		if len(args) > 1 {
+			if c, _ := findCommand(args[1:]); c != nil {
+				c.Usage()
+			}
+		}
+		flag.Usage()
+	}
+	for i := range commands {
+		if commands[i].Name == args[0] {
+			return &commands[i], args[1:]
+		}
+	}
+	return nil, args
+}
+
+func (c *command) accepts(name string) bool {
+	switch {
+	case slices.Contains(c.Mode, name):
+		return true
+	case len(c.Flags) == 0:
+		return !slices.Contains(c.Exclude, name)
+	default:
+		return slices.Contains(c.Flags, name)
+	}
+}
+
+// Setup sets the flags of the mode of the command. It should be called once
+// all the flags have been defined and before they are parsed.
+func (c *command) Setup() {
+	for _, n := range c.Mode {
+		flag.Set(n, "true")
+	}
+	flag.Usage = c.Usage
+}
+
+// Check exits with a usage error when flags not accepted by the command have
+// been given.
+func (c *command) Check() {
+	flag.Visit(func(f *flag.Flag) {
+		if !c.accepts(f.Name) {
+			fmt.Fprintf(os.Stderr, "flag -%s is not supported by the %s command\n", f.Name, c.Name)
+			os.Exit(exitUsage)
+		}
+	})
+}
+
+// Usage prints the help of the command, made of the description of the
+// options it accepts taken from the help of mvis2list.
+func (c *command) Usage() {
+	if c.Run != nil {
+		flag.Usage()
+	}
+	fmt.Fprintf(os.Stderr, "%s\n\nUsage: mvis2list %s [options] %s\n\nOptions:\n\n", c.Short, c.Name, c.Args)
+	var keep bool
+	for _, line := range strings.Split(optionsHelp(), "\n") {
+		if name, ok := strings.CutPrefix(line, "  -"); ok {
+			name, _, _ = strings.Cut(name, " ")
+			keep = c.accepts(name) && !slices.Contains(c.Mode, name)
+		}
+		if keep {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+	os.Exit(exitUsage)
+}
+
+// optionsHelp gives the Options section of the help.
+func optionsHelp() string {
+	_, text, _ := strings.Cut(helpText, "\nOptions:\n\n")
+	text, _, _ = strings.Cut(text, "\n\n")
+	return text
+}
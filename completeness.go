@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// policies applied to the listing files less complete than -min-complete
+const (
+	incompleteFlag    = "flag"
+	incompletePartial = "partial"
+	incompleteDrop    = "drop"
+)
+
+func checkIncomplete(policy string) error {
+	switch policy {
+	case incompleteFlag, incompletePartial, incompleteDrop:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy for incomplete listing files: %s", policy)
+	}
+}
+
+// parsePercent parses a percentage given as 95% or 95.
+func parsePercent(str string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(str), "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percentage: %s", str)
+	}
+	return v, nil
+}
+
+// completeness is the completeness of a listing file as reported in its
+// metadata when -min-complete is set.
+type completeness struct {
+	Min    float64 `xml:"min,attr" json:"min"`
+	Status string  `xml:"status,attr" json:"status"`
+	Value  string  `xml:",chardata" json:"value"`
+}
+
+// Completeness gives the percentage of the blocks of the listing file that
+// were found. The number of blocks expected is computed from the size given
+// in the FileFlag block so that the blocks missing at the end of the listing
+// file are counted too. Without size (or for the parts of a split listing
+// file), only the gaps between the blocks found are taken into account.
+func (m *mvis) Completeness() float64 {
+	if m.Size <= 0 || m.opts.split > 0 {
+		return qualityOf(m).Completeness()
+	}
+	expected := (m.Size + LineSize - 3) / (LineSize - 2)
+	if m.Blocks >= expected {
+		return 100
+	}
+	return float64(m.Blocks) * 100 / float64(expected)
+}
+
+// rename changes the name given to the listing file once closed and to the
+// files written next to it (index and export). The gaps map and the metadata
+// are only written once the listing file is closed: they use its new name.
+func (m *mvis) rename(n string) error {
+	if err := renameTo(m.file, n); err != nil {
+		return err
+	}
+	if m.index != nil {
+		if err := renameTo(m.index.file, indexName(n, m.index.format)); err != nil {
+			return err
+		}
+	}
+	if m.export != nil {
+		if err := renameTo(m.export.file, exportName(n)); err != nil {
+			return err
+		}
+	}
+	m.Name = n
+	return nil
+}
+
+// gate applies the policy chosen with -on-incomplete when the listing file is
+// less complete than -min-complete: the listing file is kept but flagged in
+// its metadata, given the .partial suffix or not written at all.
+func (m *mvis) gate() error {
+	if m.opts.minComplete <= 0 {
+		return nil
+	}
+	v := m.Completeness()
+	m.complete = &completeness{
+		Min:    m.opts.minComplete,
+		Status: "complete",
+		Value:  fmt.Sprintf("%.2f", v),
+	}
+	if v >= m.opts.minComplete {
+		return nil
+	}
+	m.complete.Status = "incomplete"
+	slog.Warn("incomplete listing file", "file", m.Name, "complete", m.complete.Value, "min", m.opts.minComplete, "policy", m.opts.incomplete)
+	if m.file == nil {
+		return nil
+	}
+	switch m.opts.incomplete {
+	case incompletePartial:
+		if err := m.rename(m.Name + ".partial"); err != nil {
+			return err
+		}
+	case incompleteDrop:
+		abort(m.file)
+		m.file, m.dropped = nil, true
+	}
+	return nil
+}
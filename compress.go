@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// readBuffer is the size of the buffer used to read dat files. Blocks are
+// read 64 bytes at a time: a large buffer keeps the number of reads low on
+// network filesystems where each of them is expensive.
+var readBuffer = 1 << 20
+
+// sourceFile gives access to the content of a dat file whatever the
+// compression used to store it in the archive.
+type sourceFile struct {
+	io.Reader
+
+	file  rawFile
+	raw   *countReader
+	close func() error
+	pos   int64
+	// header decoded from the beginning of the dat file, if any
+	header *vmuHeader
+	// md5 of the bytes read from the underlying file
+	digest hash.Hash
+}
+
+func openSource(p string) (*sourceFile, error) {
+	f, err := openRaw(p)
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.New()
+	raw := &countReader{Reader: io.TeeReader(f, digest)}
+	rs := bufio.NewReaderSize(raw, readBuffer)
+	magic, _ := rs.Peek(len(zstdMagic))
+
+	s := sourceFile{file: f, raw: raw, Reader: rs, digest: digest}
+	switch ext := filepath.Ext(p); {
+	case ext == ".gz" || bytes.HasPrefix(magic, gzipMagic):
+		z, err := gzip.NewReader(rs)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		s.Reader, s.close = z, z.Close
+	case ext == ".zst" || bytes.HasPrefix(magic, zstdMagic):
+		// no zstd decoder is available in the standard library: delegate the
+		// decompression to the zstd command found in the PATH.
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = rs
+		cmd.Stderr = os.Stderr
+		z, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		s.Reader = z
+		s.close = func() error {
+			z.Close()
+			// a corrupt file is only reported by the exit status of zstd
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("%s: zstd: %w", p, err)
+			}
+			return nil
+		}
+	}
+	return &s, nil
+}
+
+func (s *sourceFile) Name() string {
+	return s.file.Name()
+}
+
+// Offset gives the number of bytes read from the underlying file.
+func (s *sourceFile) Offset() int64 {
+	return s.raw.n
+}
+
+// Pos gives the number of bytes of the (decompressed) dat file read so far.
+func (s *sourceFile) Pos() int64 {
+	return s.pos
+}
+
+// Read always tries to fill bs completely since decompressors can return
+// less bytes than requested even when more are available. A short read at
+// the end of the file is not an error but a truncated compressed file is.
+func (s *sourceFile) Read(bs []byte) (int, error) {
+	n, err := io.ReadFull(s.Reader, bs)
+	s.pos += int64(n)
+	if err == io.ErrUnexpectedEOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close reports the errors of the decompressor that are only known once
+// the whole file has been read. It can be called more than once.
+func (s *sourceFile) Close() error {
+	var err error
+	if s.close != nil {
+		err, s.close = s.close(), nil
+	}
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func compressSuffix(method string) (string, error) {
+	switch method {
+	case "":
+		return "", nil
+	case "gzip":
+		return ".gz", nil
+	case "zstd":
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unsupported compression: %s", method)
+	}
+}
+
+func compressWriter(w io.Writer, method string) (io.WriteCloser, error) {
+	switch method {
+	case "":
+		return nopCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-c", "-q")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		z, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &cmdWriter{WriteCloser: z, cmd: cmd}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", method)
+	}
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countReader) Read(bs []byte) (int, error) {
+	n, err := c.Reader.Read(bs)
+	c.n += int64(n)
+	return n, err
+}
+
+// countWriter counts the bytes written. Given as the output of the zstd
+// command, it is written by the goroutine copying this output while the
+// listing file is checked for -split: the count is only accessed atomically.
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(bs []byte) (int, error) {
+	n, err := c.Writer.Write(bs)
+	c.add(n)
+	return n, err
+}
+
+func (c *countWriter) add(n int) {
+	atomic.AddInt64(&c.n, int64(n))
+}
+
+// Count gives the number of bytes written so far.
+func (c *countWriter) Count() int {
+	return int(atomic.LoadInt64(&c.n))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readConfig reads a configuration file and gives the options it contains
+// as command line arguments, followed by the list of files (or batch base
+// directory and UPI list) given by the "args" key.
+//
+// Only a flat subset of TOML (key = value) and YAML (key: value) is
+// supported. Keys are the names of the command line options.
+func readConfig(file string) ([]string, []string, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	sep := "="
+	switch filepath.Ext(file) {
+	case ".yml", ".yaml":
+		sep = ":"
+	}
+
+	var (
+		options []string
+		args    []string
+		last    string
+		s       = bufio.NewScanner(r)
+	)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") && sep == ":" {
+			if last != "args" {
+				return nil, nil, fmt.Errorf("%s:%d: list only supported for args", file, i)
+			}
+			args = append(args, unquote(line[2:]))
+			continue
+		}
+		ix := strings.Index(line, sep)
+		if ix < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: invalid line %q", file, i, line)
+		}
+		key := strings.TrimSpace(line[:ix])
+		value := strings.TrimSpace(line[ix+1:])
+		last = key
+		switch {
+		case key == "config":
+		case key == "args":
+			args = append(args, parseList(value)...)
+		case value == "":
+		default:
+			options = append(options, fmt.Sprintf("-%s=%s", key, unquote(value)))
+		}
+	}
+	return options, args, s.Err()
+}
+
+func parseList(v string) []string {
+	if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+		if v == "" {
+			return nil
+		}
+		return []string{unquote(v)}
+	}
+	var vs []string
+	for _, x := range strings.Split(v[1:len(v)-1], ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			vs = append(vs, unquote(x))
+		}
+	}
+	return vs
+}
+
+// unquote removes the quotes around v as well as a trailing comment.
+func unquote(v string) string {
+	if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+		if ix := strings.IndexByte(v[1:], v[0]); ix >= 0 {
+			return v[1 : ix+1]
+		}
+	}
+	if ix := strings.Index(v, " #"); ix >= 0 {
+		v = strings.TrimSpace(v[:ix])
+	}
+	return v
+}
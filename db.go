@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dbSchema creates the tables of the product database when they do not exist
+// yet: one row per listing file created and one per dat file it was built
+// from.
+const dbSchema = `CREATE TABLE IF NOT EXISTS listings (
+	id INTEGER PRIMARY KEY,
+	run TEXT NOT NULL,
+	name TEXT NOT NULL,
+	upi TEXT,
+	acquired_from TEXT,
+	acquired_to TEXT,
+	size INTEGER,
+	bytes INTEGER,
+	md5 TEXT,
+	blocks INTEGER,
+	missing INTEGER,
+	created TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS listings_name ON listings(name);
+CREATE INDEX IF NOT EXISTS listings_upi ON listings(upi);
+CREATE TABLE IF NOT EXISTS sources (
+	listing INTEGER NOT NULL REFERENCES listings(id),
+	path TEXT NOT NULL
+);
+`
+
+// productDB records the listing files created during the run in a SQLite
+// database (-db). Rows are appended to the ones of the previous runs in one
+// transaction at the end of the run with the sqlite3 command (that should be
+// available in the PATH).
+type productDB struct {
+	mu   sync.Mutex
+	file string
+	run  string
+	sql  bytes.Buffer
+	rows int
+}
+
+func openProductDB(file string) (*productDB, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, fmt.Errorf("-db: sqlite3 command not found: %w", err)
+	}
+	db := productDB{
+		file: file,
+		run:  time.Now().UTC().Format(time.RFC3339),
+	}
+	return &db, nil
+}
+
+// Add records the listing file m once closed.
+func (db *productDB) Add(m *mvis, upis []string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var from, to string
+	if a := acquisitionOf(m.sources); a != nil {
+		from, to = a.Start.Format(time.RFC3339), a.End.Format(time.RFC3339)
+	}
+	fmt.Fprintf(&db.sql, "INSERT INTO listings (run, name, upi, acquired_from, acquired_to, size, bytes, md5, blocks, missing, created) VALUES (%s, %s, %s, %s, %s, %d, %d, %s, %d, %d, %s);\n",
+		sqlText(db.run), sqlText(m.Name), sqlText(upiOf(m, upis)), sqlText(from), sqlText(to),
+		m.Size, m.Stats().Written, sqlText(fmt.Sprintf("%x", m.digest.Sum(nil))), m.Blocks, m.Missing,
+		sqlText(time.Now().UTC().Format(time.RFC3339)))
+	for _, p := range m.sources {
+		fmt.Fprintf(&db.sql, "INSERT INTO sources (listing, path) SELECT max(id), %s FROM listings;\n", sqlText(p))
+	}
+	db.rows++
+}
+
+// Flush writes in the database the listing files recorded since the last
+// call.
+func (db *productDB) Flush() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.rows == 0 {
+		return nil
+	}
+	var sql strings.Builder
+	sql.WriteString(dbSchema)
+	sql.WriteString("BEGIN;\n")
+	sql.Write(db.sql.Bytes())
+	sql.WriteString("COMMIT;\n")
+
+	cmd := exec.Command("sqlite3", "-bail", db.file)
+	cmd.Stdin = strings.NewReader(sql.String())
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: listing files not recorded: %w", db.file, err)
+	}
+	db.sql.Reset()
+	db.rows = 0
+	return nil
+}
+
+// sqlText quotes str as a SQL string literal (NULL when empty).
+func sqlText(str string) string {
+	if str == "" {
+		return "NULL"
+	}
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// detectBlocks is the number of blocks looked at to decide whether a listing
+// file is a text one (-auto-text).
+const detectBlocks = 16
+
+// origins of the decision taken on the kind of listing files with -auto-text
+const (
+	kindFromPayload = "payload"
+	kindFromUPI     = "upi"
+)
+
+// listingKind is the kind of a listing file given in the metadata with -auto-text.
+type listingKind struct {
+	From string `xml:"from,attr" json:"from"`
+	Kind string `xml:",chardata" json:"kind"`
+}
+
+type probed struct {
+	block  []byte
+	source string
+}
+
+// looksText reports whether the payload of the blocks is made of printable
+// text. The null bytes padding the end of the blocks are ignored but null
+// bytes found in the middle of the payload mean binary data.
+func looksText(ps []probed) bool {
+	var total, bad int
+	for _, p := range ps {
+		bs := bytes.TrimRight(dec.Payload(p.block), "\x00")
+		for len(bs) > 0 {
+			r, n := utf8.DecodeRune(bs)
+			bs = bs[n:]
+			total++
+			switch {
+			case r == '\n' || r == '\r' || r == '\t':
+			case r == 0:
+				return false
+			case r < 0x20 || r == 0x7f || r == utf8.RuneError && n == 1:
+				bad++
+			}
+		}
+	}
+	// a few control characters are tolerated
+	return total > 0 && bad*100 <= total
+}
+
+// isTextUPI reports whether the listing files of upi are text ones according
+// to the list given with -text-upi.
+func isTextUPI(upi string, set []string) bool {
+	for _, u := range set {
+		if matchUPI(u, upi) {
+			return true
+		}
+	}
+	return false
+}
+
+// setText sets the kind of the listing file once it has been decided and
+// writes the blocks kept until then.
+func (m *mvis) setText(text bool, from string) (int, error) {
+	m.probing, m.text, m.kindFrom = false, text, from
+	if text && !m.framed {
+		m.conv = &textWriter{w: m.writer, eol: m.eol, encoding: m.encoding}
+		m.writer = m.conv
+	}
+	var n int
+	for _, p := range m.probe {
+		x, err := m.emit(p.block, p.source)
+		if n += x; err != nil {
+			return n, err
+		}
+	}
+	m.probe = nil
+	return n, nil
+}
+
+// decideText decides the kind of the listing file from the blocks received
+// so far when it is still undecided.
+func (m *mvis) decideText() (int, error) {
+	if !m.probing {
+		return 0, nil
+	}
+	return m.setText(looksText(m.probe), kindFromPayload)
+}
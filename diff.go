@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	diffChanged = "content differs"
+	diffOld     = "only in old"
+	diffNew     = "only in new"
+)
+
+// diffRange is a range of consecutive blocks of two listing files differing
+// the same way. When Sequence is set, First and Last are sequence counters
+// (counting the wraps of the counter) instead of positions in the files.
+type diffRange struct {
+	First    int
+	Last     int
+	What     string
+	Sequence bool
+}
+
+func (r diffRange) String() string {
+	if r.Sequence {
+		return fmt.Sprintf("sequences %d-%d: %s", r.First&counterMask, r.Last&counterMask, r.What)
+	}
+	size := LineSize - 2
+	return fmt.Sprintf("blocks %d-%d (bytes %d-%d): %s", r.First, r.Last, r.First*size, (r.Last+1)*size-1, r.What)
+}
+
+// appendRange adds the block i to the ranges rs.
+func appendRange(rs []diffRange, i int, what string, seq bool) []diffRange {
+	if n := len(rs); n > 0 && rs[n-1].What == what && rs[n-1].Last == i-1 {
+		rs[n-1].Last = i
+		return rs
+	}
+	return append(rs, diffRange{First: i, Last: i, What: what, Sequence: seq})
+}
+
+// runDiff implements the diff command: it compares two listing files block
+// by block and reports the ranges of blocks that differ. With -sources, the
+// second listing file is recomputed from the given dat files. The returned
+// bool is set when the listing files differ.
+func runDiff(args []string) (bool, error) {
+	set := flag.NewFlagSet("diff", flag.ExitOnError)
+	sources := set.Bool("sources", false, "")
+	keep := set.Bool("keep", false, "")
+	text := set.Bool("text", false, "")
+	set.Usage = flag.Usage
+	if err := set.Parse(args); err != nil {
+		return false, err
+	}
+	if *sources && set.NArg() < 2 || !*sources && set.NArg() != 2 {
+		flag.Usage()
+	}
+	old, next := set.Arg(0), set.Arg(1)
+	if *sources {
+		dir, err := os.MkdirTemp("", "mvis2list-diff")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(dir)
+		if next, err = recompute(old, set.Args()[1:], dir, *keep, *text); err != nil {
+			return false, err
+		}
+	}
+	rs, err := diffListings(old, next)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rs {
+		fmt.Println(r)
+	}
+	return len(rs) > 0, nil
+}
+
+func exitDiff(differ bool, err error) {
+	if err != nil {
+		fatal(err)
+	}
+	if differ {
+		os.Exit(exitVerify)
+	}
+	os.Exit(exitOK)
+}
+
+// recompute converts the dat files of ps under dir and gives the listing
+// file created corresponding to listing.
+func recompute(listing string, ps []string, dir string, keep, text bool) (string, error) {
+	r, err := NewReader(ps, keep)
+	if err != nil {
+		return "", err
+	}
+	opts := options{
+		text:     text,
+		conflict: conflictOverwrite,
+		prefer:   preferFirst,
+		total:    new(quality),
+		store:    localStorage{},
+		// the index gives the sequence counters of the blocks
+		index: indexBinary,
+	}
+	if err := dumpFiles(r, dir, opts); err != nil {
+		return "", err
+	}
+	var found string
+	err = filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() || found != "" {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(listing, string(filepath.Separator)+rel) || filepath.Base(rel) == filepath.Base(listing) {
+			found = p
+		}
+		return nil
+	})
+	if err == nil && found == "" {
+		err = fmt.Errorf("%s: listing file not found in sources", listing)
+	}
+	return found, err
+}
+
+// diffListings compares the (decompressed) content of the listing files
+// old and next block by block. Blocks are matched by their sequence counters
+// when both listing files have an index (-index), by their positions
+// otherwise.
+func diffListings(old, next string) ([]diffRange, error) {
+	ix, err := readIndex(old)
+	if err != nil {
+		return nil, err
+	}
+	iy, err := readIndex(next)
+	if err != nil {
+		return nil, err
+	}
+	if ix != nil && iy != nil {
+		return diffSequences(old, next, ix, iy)
+	}
+	a, err := openSource(old)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	b, err := openSource(next)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+
+	var (
+		rs     []diffRange
+		xs, ys = make([]byte, LineSize-2), make([]byte, LineSize-2)
+	)
+	for i := 0; ; i++ {
+		nx, err := a.Read(xs)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		ny, err := b.Read(ys)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var what string
+		switch {
+		case nx == 0 && ny == 0:
+			return rs, nil
+		case ny == 0:
+			what = diffOld
+		case nx == 0:
+			what = diffNew
+		case !bytes.Equal(xs[:nx], ys[:ny]):
+			what = diffChanged
+		default:
+			continue
+		}
+		rs = appendRange(rs, i, what, false)
+	}
+}
+
+// diffSequences compares the blocks of the listing files old and next with
+// the same sequence counters, as given by their indexes xs and ys.
+func diffSequences(old, next string, xs, ys []indexEntry) ([]diffRange, error) {
+	a, err := readListing(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readListing(next)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		rs     []diffRange
+		as, bs = unwrapIndex(xs), unwrapIndex(ys)
+		i, j   int
+	)
+	for i < len(xs) || j < len(ys) {
+		switch {
+		case j >= len(ys) || i < len(xs) && as[i] < bs[j]:
+			rs = appendRange(rs, as[i], diffOld, true)
+			i++
+		case i >= len(xs) || bs[j] < as[i]:
+			rs = appendRange(rs, bs[j], diffNew, true)
+			j++
+		default:
+			x, err := payloadOf(a, xs[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", old, err)
+			}
+			y, err := payloadOf(b, ys[j])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", next, err)
+			}
+			if !bytes.Equal(x, y) {
+				rs = appendRange(rs, as[i], diffChanged, true)
+			}
+			i++
+			j++
+		}
+	}
+	return rs, nil
+}
+
+// unwrapIndex sorts the entries of xs by sequence counter and gives their
+// counters counting the wraps of the counter since the first block.
+func unwrapIndex(xs []indexEntry) []int {
+	var (
+		seqs = make([]int, len(xs))
+		wrap int
+	)
+	for i, x := range xs {
+		if i > 0 && int(xs[i-1].Seq)-int(x.Seq) > counterLimit/2 {
+			wrap++
+		}
+		seqs[i] = wrap*counterLimit + int(x.Seq)
+	}
+	sort.Stable(byCounter{xs, seqs})
+	return seqs
+}
+
+type byCounter struct {
+	xs   []indexEntry
+	seqs []int
+}
+
+func (b byCounter) Len() int           { return len(b.xs) }
+func (b byCounter) Less(i, j int) bool { return b.seqs[i] < b.seqs[j] }
+func (b byCounter) Swap(i, j int) {
+	b.xs[i], b.xs[j] = b.xs[j], b.xs[i]
+	b.seqs[i], b.seqs[j] = b.seqs[j], b.seqs[i]
+}
+
+// readListing gives the (decompressed) content of the listing file.
+func readListing(file string) ([]byte, error) {
+	r, err := openSource(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r.Reader)
+}
+
+func payloadOf(bs []byte, x indexEntry) ([]byte, error) {
+	end := x.Offset + int64(x.Size)
+	if x.Offset < 0 || end > int64(len(bs)) {
+		return nil, fmt.Errorf("block %d out of the listing file (offset %d, size %d)", x.Seq, x.Offset, x.Size)
+	}
+	return bs[x.Offset:end], nil
+}
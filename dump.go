@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// hexdumpBlocks prints every block of r like hexdump -C does, preceded by
+// the sequence counter of the block and by a marker when blocks are missing.
+// When r reads dat files, offsets are given relative to the start of the dat
+// file the block comes from.
+func hexdumpBlocks(r io.Reader) error {
+	var (
+		prev   uint16
+		name   string
+		file   string
+		offset int64
+		buf    = make([]byte, LineSize)
+	)
+	for {
+		b, err := nextBlock(r, buf)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		body := b.Bytes()
+		offset += int64(LineSize)
+		pos := offset - int64(LineSize)
+		if f, ok := r.(*fileReader); ok && f.file != nil {
+			if n := f.file.Name(); n != file {
+				file = n
+				fmt.Printf("== %s\n", file)
+			}
+			pos = f.file.Pos() - int64(LineSize)
+		}
+		s := b.Sequence()
+		switch diff := (s - prev) & counterMask; {
+		case b.IsFileHeader():
+			var size int
+			name, size = b.File()
+			fmt.Printf("-- file %s (%s)\n", name, formatSize(int64(size)))
+			prev = 0
+		case diff != s && diff > counterLimit/2:
+			fmt.Printf("-- out of order: %d after %d\n", s, prev)
+		case diff != s && diff > 1:
+			fmt.Printf("-- missing %d blocks: %d - %d\n", diff-1, (prev+1)&counterMask, (s-1)&counterMask)
+		}
+		if !b.IsFileHeader() {
+			fmt.Printf("-- block %d (%s)\n", s, name)
+			prev = s
+		}
+		hexdump(os.Stdout, pos, body)
+	}
+	return nil
+}
+
+func hexdump(w io.Writer, offset int64, body []byte) {
+	const width = 16
+	for i := 0; i < len(body); i += width {
+		line := body[i:]
+		if len(line) > width {
+			line = line[:width]
+		}
+		fmt.Fprintf(w, "%08x ", offset+int64(i))
+		for j := 0; j < width; j++ {
+			if j%8 == 0 {
+				fmt.Fprint(w, " ")
+			}
+			if j < len(line) {
+				fmt.Fprintf(w, "%02x ", line[j])
+			} else {
+				fmt.Fprint(w, "   ")
+			}
+		}
+		fmt.Fprint(w, " |")
+		for _, c := range line {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			fmt.Fprintf(w, "%c", c)
+		}
+		fmt.Fprintln(w, "|")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitMissing     = 3
+	exitBadFiles    = 4
+	exitVerify      = 5
+	exitInterrupted = 6
+)
+
+// exitCode gives the exit code reflecting the quality of the listing files
+// produced during the run.
+func exitCode(r io.Reader, opts options, strict bool) int {
+	if opts.verify != nil {
+		if err := opts.verify.Err(); err != nil {
+			slog.Error(err.Error())
+			return exitVerify
+		}
+	}
+	if !strict {
+		return exitOK
+	}
+	if f, ok := r.(*fileReader); ok && f.Skipped() > 0 {
+		slog.Warn("bad files skipped", "count", f.Skipped())
+		return exitBadFiles
+	}
+	if opts.total.Missing > 0 {
+		slog.Warn("blocks missing", "count", opts.total.Missing)
+		return exitMissing
+	}
+	return exitOK
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const exportCSV = "csv"
+
+func checkExport(format string) error {
+	switch format {
+	case "", exportCSV:
+		return nil
+	default:
+		return fmt.Errorf("invalid export format: %s", format)
+	}
+}
+
+// csvExport writes the lines of the payload of a text listing file as the
+// rows of a CSV file: the sequence counter of the block where the line
+// starts, the number of the line and the line itself (without its line
+// terminator). Null bytes are dropped from the payload.
+type csvExport struct {
+	file  io.WriteCloser
+	buf   *bufio.Writer
+	w     *csv.Writer
+	count int
+	// beginning of the last line not terminated yet and the block where it
+	// starts
+	line  []byte
+	first uint16
+}
+
+// exportName gives the name of the CSV export of the listing file n.
+func exportName(n string) string {
+	return n + ".csv"
+}
+
+func newExport(store storage, n string) (*csvExport, error) {
+	f, err := store.Create(exportName(n))
+	if err != nil {
+		return nil, err
+	}
+	e := csvExport{
+		file: f,
+		buf:  bufio.NewWriter(f),
+	}
+	e.w = csv.NewWriter(e.buf)
+	e.w.Write([]string{"sequence", "line", "record"})
+	return &e, nil
+}
+
+// Add gives the payload of the block seq to the export.
+func (e *csvExport) Add(seq uint16, payload []byte) error {
+	payload = bytes.ReplaceAll(payload, []byte{0}, nil)
+	for len(payload) > 0 {
+		if len(e.line) == 0 {
+			e.first = seq
+		}
+		ix := bytes.IndexByte(payload, '\n')
+		if ix < 0 {
+			e.line = append(e.line, payload...)
+			return nil
+		}
+		e.line = append(e.line, payload[:ix]...)
+		payload = payload[ix+1:]
+		if err := e.flushLine(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *csvExport) flushLine() error {
+	e.count++
+	line := bytes.TrimSuffix(e.line, []byte("\r"))
+	e.line = e.line[:0]
+	return e.w.Write([]string{strconv.Itoa(int(e.first)), strconv.Itoa(e.count), string(line)})
+}
+
+func (e *csvExport) Close() error {
+	if len(e.line) > 0 {
+		e.flushLine()
+	}
+	e.w.Flush()
+	err := e.w.Error()
+	if err == nil {
+		err = e.buf.Flush()
+	}
+	if err != nil {
+		abort(e.file)
+		return err
+	}
+	return e.file.Close()
+}
+
+func (e *csvExport) Abort() {
+	abort(e.file)
+}
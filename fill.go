@@ -0,0 +1,36 @@
+package main
+
+import "bytes"
+
+// keepFill is set when the payload of fill blocks (MilFlag) is given to the
+// consumers of the readers instead of being dropped.
+var keepFill bool
+
+// writeFill writes the payload of a fill block to the listing file after the
+// block received before it. Fill blocks have no sequence counter: they are
+// neither checked nor kept in the reordering window.
+func (m *mvis) writeFill(bs []byte) (int, error) {
+	n, err := m.commit()
+	if err != nil {
+		return n, err
+	}
+	x, err := m.decideText()
+	if n += x; err != nil {
+		return n, err
+	}
+	m.held = nil
+	block, payload := bs, dec.Payload(bs)
+	bs = payload
+	if m.text {
+		bs = bytes.TrimRight(bs, "\x00")
+	}
+	data := bs
+	if m.framed {
+		bs = appendRecord(nil, recordFill, MilFlag, bs)
+	}
+	if _, err := m.writer.Write(bs); err != nil {
+		return 0, err
+	}
+	m.count(block, payload, data)
+	return n + len(bs), nil
+}
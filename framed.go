@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// formats of the listing files (-format)
+const (
+	formatRaw    = "raw"
+	formatFramed = "framed"
+)
+
+// framedMagic starts the listing files written with -format framed. It is
+// followed by the size of the payload of the blocks (2 bytes, big endian) and
+// by the records.
+var framedMagic = []byte("MVL2")
+
+// kinds of the records of framed listing files. A record is made of its
+// kind (1 byte), a sequence counter (2 bytes), the length of its data
+// (2 bytes) and its data:
+//
+//	block  counter of the block, payload
+//	gap    first counter missing, number of blocks missing (2 bytes)
+//	fill   MilFlag, payload of the fill block
+const (
+	recordBlock = 'B'
+	recordGap   = 'G'
+	recordFill  = 'F'
+)
+
+func checkFormat(format, eol, encoding string) error {
+	switch format {
+	case "", formatRaw:
+	case formatFramed:
+		if eol != "" || encoding != "" {
+			return fmt.Errorf("-eol and -encoding can not be used with the %s format", format)
+		}
+	default:
+		return fmt.Errorf("invalid format: %s", format)
+	}
+	return nil
+}
+
+// framedHeader gives the beginning of a framed listing file.
+func framedHeader() []byte {
+	return binary.BigEndian.AppendUint16(append([]byte(nil), framedMagic...), uint16(LineSize-2))
+}
+
+// appendRecord appends to bs the record of the given kind.
+func appendRecord(bs []byte, kind byte, counter uint16, data []byte) []byte {
+	bs = append(bs, kind)
+	bs = binary.BigEndian.AppendUint16(bs, counter)
+	bs = binary.BigEndian.AppendUint16(bs, uint16(len(data)))
+	return append(bs, data...)
+}
+
+// gapRecord gives the record of the blocks missing before a block.
+func gapRecord(g gap) []byte {
+	return appendRecord(nil, recordGap, g.First, binary.BigEndian.AppendUint16(nil, uint16(g.Count)))
+}
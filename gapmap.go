@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// gapsMagic starts the map of the missing blocks of a listing file.
+var gapsMagic = []byte("MVGP")
+
+// gapMap records the sequence counters of the blocks missing in a listing
+// file (-gaps-map) so that they can be requested again to the ground
+// segment. It is written next to the listing file (NAME.gaps) as:
+//
+//	magic     MVGP
+//	limit     number of counters in a wrap (2 bytes)
+//	wraps     number of wraps of the counter covered by the file (4 bytes)
+//	count     number of bitmaps that follow (4 bytes)
+//	bitmaps   for each wrap with missing blocks, its number (4 bytes, the
+//	          wrap of the first block received being 0) and a bitmap of
+//	          limit bits, one per counter (most significant bit first), set
+//	          when the block is missing
+//
+// All numbers are big endian. The blocks missing before the first block
+// received are not known and are not in the map.
+type gapMap struct {
+	// wrap of the counter of the last block
+	wrap int
+	maps map[int][]byte
+}
+
+func newGapMap() *gapMap {
+	return &gapMap{maps: make(map[int][]byte)}
+}
+
+// Advance moves from the block prev to the block s (following it). When gap
+// is set, the blocks between them are marked as missing.
+func (g *gapMap) Advance(prev, s uint16, gap bool) {
+	if g == nil {
+		return
+	}
+	diff := int((s - prev) & counterMask)
+	if gap {
+		g.mark(prev, diff-1)
+	}
+	g.wrap = (g.wrap*counterLimit + int(prev) + diff) / counterLimit
+}
+
+// mark marks as missing the count blocks following the block last.
+func (g *gapMap) mark(last uint16, count int) {
+	base := g.wrap*counterLimit + int(last)
+	for k := 1; k <= count; k++ {
+		w, c := (base+k)/counterLimit, (base+k)%counterLimit
+		bs, ok := g.maps[w]
+		if !ok {
+			bs = make([]byte, counterLimit/8)
+			g.maps[w] = bs
+		}
+		bs[c/8] |= 0x80 >> (c % 8)
+	}
+}
+
+// Bytes gives the content of the NAME.gaps file.
+func (g *gapMap) Bytes() []byte {
+	ws := make([]int, 0, len(g.maps))
+	for w := range g.maps {
+		ws = append(ws, w)
+	}
+	slices.Sort(ws)
+
+	bs := append([]byte(nil), gapsMagic...)
+	bs = binary.BigEndian.AppendUint16(bs, counterLimit)
+	bs = binary.BigEndian.AppendUint32(bs, uint32(max(g.wrap, slices.Max(append(ws, 0)))+1))
+	bs = binary.BigEndian.AppendUint32(bs, uint32(len(ws)))
+	for _, w := range ws {
+		bs = binary.BigEndian.AppendUint32(bs, uint32(w))
+		bs = append(bs, g.maps[w]...)
+	}
+	return bs
+}
+
+// missingTail gives the number of blocks missing at the end of the listing
+// file m according to the size announced (0 when it is only a part of the
+// listing).
+func (m *mvis) missingTail() int {
+	if m.opts.split > 0 || m.opts.rotate != nil {
+		return 0
+	}
+	expected := (m.Size + LineSize - 3) / (LineSize - 2)
+	return max(expected-m.Blocks-m.Missing, 0)
+}
+
+// writeGapMap writes the map of the missing blocks next to the listing file
+// m, including the blocks missing at its end.
+func (m *mvis) writeGapMap() error {
+	if tail := m.missingTail(); tail > 0 {
+		m.gapMap.mark(m.last, tail)
+	}
+	w, err := m.store.Create(m.Name + ".gaps")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.gapMap.Bytes()); err != nil {
+		abort(w)
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// genSpec describes the synthetic dat files created by the gen command.
+type genSpec struct {
+	Dir     string
+	UPI     string
+	Channel int
+	Name    string
+	Start   time.Time
+	Files   int
+	Blocks  int
+	Gaps    int
+	Dups    int
+	Bad     int
+	Fills   int
+	Archive bool
+}
+
+// runGen implements the gen command: it creates a set of dat files holding
+// one listing file with the defects requested (missing and duplicated blocks,
+// bad files and fill blocks). The same seed always gives the same files.
+func runGen(args []string) error {
+	var (
+		spec  genSpec
+		start string
+	)
+	set := flag.NewFlagSet("gen", flag.ExitOnError)
+	set.StringVar(&spec.UPI, "upi", "TEST", "")
+	set.IntVar(&spec.Channel, "channel", 51, "")
+	set.StringVar(&spec.Name, "name", "listing.txt", "")
+	set.StringVar(&start, "start", "2018-01-01T00:00:00Z", "")
+	set.IntVar(&spec.Files, "files", 4, "")
+	set.IntVar(&spec.Blocks, "blocks", 100, "")
+	set.IntVar(&spec.Gaps, "gaps", 0, "")
+	set.IntVar(&spec.Dups, "duplicates", 0, "")
+	set.IntVar(&spec.Bad, "bad", 0, "")
+	set.IntVar(&spec.Fills, "fill", 0, "")
+	set.BoolVar(&spec.Archive, "archive", false, "")
+	seed := set.Int64("seed", 1, "")
+	set.Usage = flag.Usage
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		flag.Usage()
+	}
+	spec.Dir = set.Arg(0)
+
+	var err error
+	if spec.Start, err = time.Parse(time.RFC3339, start); err != nil {
+		return fmt.Errorf("invalid start time: %s", start)
+	}
+	switch {
+	case spec.Files <= 0 || spec.Blocks <= 0:
+		return fmt.Errorf("invalid number of files or blocks: %d/%d", spec.Files, spec.Blocks)
+	case spec.Files*spec.Blocks >= counterLimit:
+		return fmt.Errorf("too many blocks: %d (at most %d)", spec.Files*spec.Blocks, counterLimit-1)
+	case spec.Bad > spec.Files:
+		return fmt.Errorf("too many bad files: %d (%d files)", spec.Bad, spec.Files)
+	case spec.Gaps < 0 || spec.Dups < 0 || spec.Bad < 0 || spec.Fills < 0:
+		return fmt.Errorf("invalid number of defects")
+	}
+	return generate(spec, rand.New(rand.NewSource(*seed)))
+}
+
+// generate writes the dat files described by spec. Each file covers one
+// minute of acquisition and holds spec.Blocks blocks (the first file also
+// starts with the FileFlag block). Blocks are removed from the healthy
+// files only: the bad files (version 2, .bad) keep all the blocks of their
+// acquisition followed by garbled data.
+func generate(spec genSpec, rnd *rand.Rand) error {
+	total := spec.Files * spec.Blocks
+	payload := LineSize - 2
+
+	pick := func(n int) map[int]bool {
+		set := make(map[int]bool)
+		for _, i := range rnd.Perm(total - 1)[:min(n, total-1)] {
+			// the first block is never altered
+			set[i+1] = true
+		}
+		return set
+	}
+	gaps, dups, fills := pick(spec.Gaps), pick(spec.Dups), pick(spec.Fills)
+	bad := make(map[int]bool)
+	for _, i := range rnd.Perm(spec.Files)[:spec.Bad] {
+		bad[i] = true
+	}
+
+	block := func(seq int) []byte {
+		bs := make([]byte, LineSize)
+		binary.BigEndian.PutUint16(bs, uint16(seq+1))
+		copy(bs[2:], fmt.Sprintf("line %05d hello world\n", seq+1))
+		return bs
+	}
+	var missing, dup, fill int
+	for i := 0; i < spec.Files; i++ {
+		var good, all []byte
+		if i == 0 {
+			head := make([]byte, LineSize)
+			binary.BigEndian.PutUint16(head, FileFlag)
+			binary.BigEndian.PutUint32(head[2:], uint32(total*payload))
+			copy(head[6:], spec.Name)
+			good = append(good, head...)
+			all = append(all, head...)
+		}
+		for j := i * spec.Blocks; j < (i+1)*spec.Blocks; j++ {
+			bs := block(j)
+			all = append(all, bs...)
+			if gaps[j] {
+				missing++
+				continue
+			}
+			good = append(good, bs...)
+			if dups[j] {
+				dup++
+				good = append(good, bs...)
+			}
+			if fills[j] {
+				fill++
+				bs = make([]byte, LineSize)
+				binary.BigEndian.PutUint16(bs, MilFlag)
+				good = append(good, bs...)
+			}
+		}
+		when := spec.Start.Add(time.Duration(i) * time.Minute)
+		if err := writeDat(spec, when, 1, i, good); err != nil {
+			return err
+		}
+		if bad[i] {
+			garbled := make([]byte, LineSize+LineSize/2)
+			rnd.Read(garbled)
+			if err := writeDat(spec, when, 2, i, append(all, garbled...)); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("%d files, %d blocks (%d missing, %d duplicated), %d fill blocks, %d bad files\n", spec.Files, total, missing, dup, fill, len(bad))
+	return nil
+}
+
+// writeDat writes the blocks bs in the dat file of the given version
+// acquired at when. The VMU header gives the number of the file as counter.
+func writeDat(spec genSpec, when time.Time, version, count int, bs []byte) error {
+	dir := spec.Dir
+	if spec.Archive {
+		dir = filepath.Join(dir, fmt.Sprint(spec.Channel), when.Format("2006"), fmt.Sprintf("%03d", when.YearDay()), when.Format("15"), when.Format("04"))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%04d_%s_%s_%03d_%s_%d.dat", spec.Channel, spec.UPI, when.Format("2006"), when.YearDay(), when.Format("15_04"), version)
+	if version > 1 {
+		name += ".bad"
+	}
+	hdr := make([]byte, len(FCC)+headerLen)
+	copy(hdr, FCC)
+	if headerLen >= 12 {
+		vmu := hdr[len(FCC):]
+		vmu[0] = byte(spec.Channel)
+		binary.BigEndian.PutUint32(vmu[1:], uint32(count))
+		binary.BigEndian.PutUint32(vmu[5:], uint32(when.Sub(gpsEpoch)/time.Second))
+	}
+	return os.WriteFile(filepath.Join(dir, name), append(hdr, bs...), 0644)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandPaths replaces the glob patterns and the archives of ps by the dat
+// files they give.
+func expandPaths(ps []string) ([]string, error) {
+	ps, err := expandGlobs(ps)
+	if err != nil {
+		return nil, err
+	}
+	return expandArchives(ps)
+}
+
+// expandGlobs replaces the glob patterns of ps by the files matching them so
+// that patterns can be given quoted instead of being expanded by the shell
+// (limited by ARG_MAX). Besides the patterns of filepath.Match, ** matches
+// any number of directories (/var/hdk/51/2018/**/*.dat) or, at the end of
+// the pattern, all the files found under a directory. Paths of existing
+// files and remote files are never expanded.
+func expandGlobs(ps []string) ([]string, error) {
+	var xs []string
+	for _, p := range ps {
+		if isRemote(p) || !hasGlob(p) {
+			xs = append(xs, p)
+			continue
+		}
+		if _, err := os.Lstat(p); err == nil {
+			xs = append(xs, p)
+			continue
+		}
+		ms, err := globFiles(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(ms) == 0 {
+			slog.Warn("no files matching pattern", "pattern", p)
+		}
+		xs = append(xs, ms...)
+	}
+	return xs, nil
+}
+
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// globFiles gives the files (not the directories) matching pattern. Only
+// the directories that can hold matching files are visited.
+func globFiles(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	// the directory of the first element with a pattern is the root of the
+	// walk
+	var root string
+	for len(parts) > 0 && !hasGlob(parts[0]) {
+		root, parts = filepath.Join(root, parts[0]), parts[1:]
+		if root == "" {
+			root = string(filepath.Separator)
+		}
+	}
+	if root == "" {
+		root = "."
+	}
+	for _, p := range parts {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		files []string
+		seen  = make(map[string]struct{})
+	)
+	err := globWalk(root, parts, func(p string) {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			files = append(files, p)
+		}
+	})
+	return files, err
+}
+
+func globWalk(dir string, parts []string, fn func(string)) error {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return nil
+		}
+		return err
+	}
+	part, last := parts[0], len(parts) == 1
+	if part == "**" && !last {
+		// ** matching no directory
+		if err := globWalk(dir, parts[1:], fn); err != nil {
+			return err
+		}
+	}
+	for _, e := range es {
+		p := filepath.Join(dir, e.Name())
+		if part == "**" {
+			if e.IsDir() {
+				if err := globWalk(p, parts, fn); err != nil {
+					return err
+				}
+			} else if last {
+				fn(p)
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(part, e.Name()); !ok {
+			continue
+		}
+		switch {
+		case last && !e.IsDir():
+			fn(p)
+		case !last && e.IsDir():
+			if err := globWalk(p, parts[1:], fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
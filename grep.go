@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// parsePattern gives the bytes searched by -grep. Patterns starting with 0x
+// are given in hexadecimal (spaces are allowed between bytes), the others are
+// searched as is.
+func parsePattern(str string) ([]byte, error) {
+	if str == "" {
+		return nil, nil
+	}
+	h, ok := strings.CutPrefix(str, "0x")
+	if !ok {
+		return []byte(str), nil
+	}
+	bs, err := hex.DecodeString(strings.ReplaceAll(h, " ", ""))
+	if err != nil || len(bs) == 0 {
+		return nil, fmt.Errorf("invalid pattern %q: hexadecimal bytes expected", str)
+	}
+	return bs, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hook is called once a listing file (and its metadata) has been written.
+// Programs embedding the conversion give their own hooks in options.hooks,
+// -post-cmd adds a commandHook.
+type hook interface {
+	Done(m *mvis) error
+}
+
+// commandHook runs a command for each listing file. The placeholders {file},
+// {meta} and {name} of the arguments are replaced by the path of the listing
+// file, the path of its metadata (empty without -meta) and its name. Details
+// on the listing file are given in the environment of the command.
+type commandHook struct {
+	args []string
+	meta bool
+}
+
+func newCommandHook(cmd string, meta bool) (*commandHook, error) {
+	args, err := splitCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return &commandHook{args: args, meta: meta}, nil
+}
+
+func (h *commandHook) Done(m *mvis) error {
+	var meta string
+	if h.meta {
+		meta = m.Name + ".xml"
+	}
+	r := strings.NewReplacer("{file}", m.Name, "{meta}", meta, "{name}", filepath.Base(m.Name))
+	args := make([]string, len(h.args))
+	for i, a := range h.args {
+		args[i] = r.Replace(a)
+	}
+	gaps := make([]string, len(m.Gaps))
+	for i, g := range m.Gaps {
+		gaps[i] = fmt.Sprintf("%d-%d", g.First, g.Last)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"MVIS2LIST_FILE="+m.Name,
+		"MVIS2LIST_META="+meta,
+		"MVIS2LIST_SIZE="+strconv.Itoa(m.Stats().Stored),
+		"MVIS2LIST_MD5="+fmt.Sprintf("%x", m.digest.Sum(nil)),
+		"MVIS2LIST_BLOCKS="+strconv.Itoa(m.Blocks),
+		"MVIS2LIST_MISSING="+strconv.Itoa(m.Missing),
+		"MVIS2LIST_GAPS="+strings.Join(gaps, ","),
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: post command failed: %w", m.Name, err)
+	}
+	return nil
+}
+
+// splitCommand splits cmd in arguments separated by spaces. Single and double
+// quotes can be used to give arguments with spaces.
+func splitCommand(cmd string) ([]string, error) {
+	var (
+		args  []string
+		curr  strings.Builder
+		quote rune
+		arg   bool
+	)
+	for _, c := range cmd {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			curr.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, arg = c, true
+		case c == ' ' || c == '\t':
+			if arg {
+				args = append(args, curr.String())
+				curr.Reset()
+				arg = false
+			}
+		default:
+			curr.WriteRune(c)
+			arg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", cmd)
+	}
+	if arg {
+		args = append(args, curr.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	indexCSV    = "csv"
+	indexBinary = "bin"
+)
+
+func checkIndex(format string) error {
+	switch format {
+	case "", indexCSV, indexBinary:
+		return nil
+	default:
+		return fmt.Errorf("invalid index format: %s", format)
+	}
+}
+
+// blockIndex gives for each block written in a listing file its sequence
+// counter, the offset and the size of its payload in the (uncompressed)
+// listing file. The csv format also gives the dat file the block comes
+// from. The binary format is made of records of 12 bytes: counter (2
+// bytes), offset (8 bytes) and size (2 bytes), big endian.
+type blockIndex struct {
+	file   io.WriteCloser
+	buf    *bufio.Writer
+	format string
+}
+
+// indexName gives the name of the index of the listing file n.
+func indexName(n, format string) string {
+	if format == indexCSV {
+		return n + ".idx.csv"
+	}
+	return n + ".idx"
+}
+
+func newIndex(store storage, n, format string) (*blockIndex, error) {
+	w, err := store.Create(indexName(n, format))
+	if err != nil {
+		return nil, err
+	}
+	x := blockIndex{
+		file:   w,
+		buf:    bufio.NewWriter(w),
+		format: format,
+	}
+	if format == indexCSV {
+		x.buf.WriteString("sequence,offset,size,source\n")
+	}
+	return &x, nil
+}
+
+func (x *blockIndex) Add(seq uint16, offset int64, size int, source string) error {
+	if x.format == indexCSV {
+		_, err := fmt.Fprintf(x.buf, "%d,%d,%d,%s\n", seq, offset, size, source)
+		return err
+	}
+	var rec [12]byte
+	binary.BigEndian.PutUint16(rec[0:], seq)
+	binary.BigEndian.PutUint64(rec[2:], uint64(offset))
+	binary.BigEndian.PutUint16(rec[10:], uint16(size))
+	_, err := x.buf.Write(rec[:])
+	return err
+}
+
+func (x *blockIndex) Close() error {
+	if err := x.buf.Flush(); err != nil {
+		abort(x.file)
+		return err
+	}
+	return x.file.Close()
+}
+
+func (x *blockIndex) Abort() {
+	abort(x.file)
+}
+
+// indexEntry is a block of a listing file found in its index.
+type indexEntry struct {
+	Seq    uint16
+	Offset int64
+	Size   int
+}
+
+// readIndex reads the index written next to the listing file n, in either
+// format. No entries and no error are given when n has no index.
+func readIndex(n string) ([]indexEntry, error) {
+	r, err := os.Open(indexName(n, indexBinary))
+	if err == nil {
+		defer r.Close()
+		return readIndexBinary(bufio.NewReader(r))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if r, err = os.Open(indexName(n, indexCSV)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	return readIndexCSV(r)
+}
+
+func readIndexBinary(r io.Reader) ([]indexEntry, error) {
+	var (
+		xs  []indexEntry
+		rec [12]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF {
+				return xs, nil
+			}
+			return nil, err
+		}
+		xs = append(xs, indexEntry{
+			Seq:    binary.BigEndian.Uint16(rec[0:]),
+			Offset: int64(binary.BigEndian.Uint64(rec[2:])),
+			Size:   int(binary.BigEndian.Uint16(rec[10:])),
+		})
+	}
+}
+
+func readIndexCSV(r io.Reader) ([]indexEntry, error) {
+	rs := csv.NewReader(r)
+	rs.FieldsPerRecord = 4
+	if _, err := rs.Read(); err != nil {
+		return nil, err
+	}
+	var xs []indexEntry
+	for {
+		row, err := rs.Read()
+		if err == io.EOF {
+			return xs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq, err := strconv.ParseUint(row[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, indexEntry{Seq: uint16(seq), Offset: offset, Size: size})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// decoder describes how the data of an instrument are framed in the dat
+// files of the hadock archive: blocks of fixed size starting with a sequence
+// counter, some values of the counter flagging special blocks.
+type decoder interface {
+	// Magic gives the four-char code found at the beginning of the dat files
+	// and HeaderLen the number of bytes of the header following it.
+	Magic() string
+	HeaderLen() int
+
+	LineSize() int
+	FileFlag() uint16
+	FillFlag() uint16
+
+	// File gives the name and the size of the file announced by a block
+	// flagged with FileFlag.
+	File(block []byte) (string, int)
+	// Payload gives the bytes of a data block to write in the output file.
+	Payload(block []byte) []byte
+}
+
+var decoders = make(map[string]decoder)
+
+func register(name string, d decoder) {
+	decoders[name] = d
+}
+
+func init() {
+	register("mvis", mvisDecoder{})
+}
+
+// dec is the decoder of the instrument selected with -instrument.
+var dec decoder = mvisDecoder{}
+
+// useDecoder selects the decoder registered under name. The framing
+// parameters used by the readers are set accordingly.
+func useDecoder(name string) error {
+	d, ok := decoders[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for n := range decoders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown instrument %s (available: %s)", name, strings.Join(names, ", "))
+	}
+	dec = d
+	FCC = []byte(d.Magic())
+	headerLen = d.HeaderLen()
+	LineSize = d.LineSize()
+	FileFlag = d.FileFlag()
+	MilFlag = d.FillFlag()
+	return nil
+}
+
+type mvisDecoder struct{}
+
+func (mvisDecoder) Magic() string    { return "MMA " }
+func (mvisDecoder) HeaderLen() int   { return 12 }
+func (mvisDecoder) LineSize() int    { return 64 }
+func (mvisDecoder) FileFlag() uint16 { return 0xFFFF }
+func (mvisDecoder) FillFlag() uint16 { return 0xFFFE }
+
+func (mvisDecoder) File(block []byte) (string, int) {
+	size := binary.BigEndian.Uint32(block[2:])
+	return string(bytes.Trim(block[6:], "\x00")), int(size)
+}
+
+func (mvisDecoder) Payload(block []byte) []byte {
+	return block[2:]
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+const (
+	interruptKeep   = "keep"
+	interruptDelete = "delete"
+	interruptMark   = "mark"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// trapSignals gives the channel receiving SIGINT and SIGTERM. Only the first
+// signal is trapped: the next one terminates the program immediately. The
+// channel is closed once the signal has been given so that all the readers
+// waiting for it are woken up.
+func trapSignals() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	q := make(chan os.Signal, 1)
+	go func() {
+		s := <-c
+		signal.Stop(c)
+		q <- s
+		close(q)
+	}()
+	return q
+}
+
+// interrupter closes the listeners and connections registered when a signal
+// is received so that the calls blocked on them return. Their errors are then
+// given as errInterrupted.
+type interrupter struct {
+	mu      sync.Mutex
+	closers []io.Closer
+	done    bool
+}
+
+func newInterrupter(signals <-chan os.Signal) *interrupter {
+	x := new(interrupter)
+	if signals == nil {
+		return x
+	}
+	go func() {
+		<-signals
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		x.done = true
+		for _, c := range x.closers {
+			c.Close()
+		}
+	}()
+	return x
+}
+
+// Add registers c to be closed on interruption.
+func (x *interrupter) Add(c io.Closer) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.done {
+		c.Close()
+	}
+	x.closers = append(x.closers, c)
+}
+
+// Remove forgets c once closed.
+func (x *interrupter) Remove(c io.Closer) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i := range x.closers {
+		if x.closers[i] == c {
+			x.closers = append(x.closers[:i], x.closers[i+1:]...)
+			break
+		}
+	}
+}
+
+// Err gives errInterrupted instead of err after an interruption.
+func (x *interrupter) Err(err error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err != nil && x.done {
+		return errInterrupted
+	}
+	return err
+}
+
+// Reader gives the errors of r through Err.
+func (x *interrupter) Reader(r io.Reader) io.Reader {
+	return interruptReader{Reader: r, x: x}
+}
+
+type interruptReader struct {
+	io.Reader
+	x *interrupter
+}
+
+func (r interruptReader) Read(bs []byte) (int, error) {
+	n, err := r.Reader.Read(bs)
+	return n, r.x.Err(err)
+}
+
+// interruptFile closes a listing file still open when the run is interrupted.
+// Complete listing files are closed as usual, the others are kept, deleted or
+// kept with a name.incomplete file next to them according to the policy.
+func interruptFile(m *mvis, opts options) error {
+	if m.Complete() || opts.interrupt == interruptKeep {
+		return closeFile(m, opts)
+	}
+	written := !opts.dryrun && opts.verify == nil
+	switch opts.interrupt {
+	case interruptDelete:
+		err := m.Close()
+		if written {
+			opts.store.Remove(m.Name)
+			slog.Warn("incomplete listing removed", "file", m.Name)
+		}
+		return err
+	case interruptMark:
+		if err := closeFile(m, opts); err != nil || !written {
+			return err
+		}
+		w, err := opts.store.Create(m.Name + ".incomplete")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "interrupted after %d blocks (%d missing)\n", m.Blocks, m.Missing)
+		slog.Warn("incomplete listing marked", "file", m.Name)
+		return w.Close()
+	default:
+		return closeFile(m, opts)
+	}
+}
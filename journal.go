@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalFile is the name of the journal written in datadir with -journal.
+const journalFile = ".mvis2list-journal"
+
+// events recorded in the journal
+const (
+	journalStart  = "start"
+	journalOpen   = "open"
+	journalRead   = "read"
+	journalSkip   = "skip"
+	journalCreate = "create"
+	journalClose  = "close"
+	journalDrop   = "drop"
+	journalAbort  = "abort"
+	journalError  = "error"
+	journalEnd    = "end"
+)
+
+// journal is the journal of the run, if any (-journal).
+var journal *runJournal
+
+// journalEntry is one line (JSON) of the journal.
+type journalEntry struct {
+	When    time.Time `json:"time"`
+	Pid     int       `json:"pid"`
+	Event   string    `json:"event"`
+	File    string    `json:"file,omitempty"`
+	Args    []string  `json:"args,omitempty"`
+	MD5     string    `json:"md5,omitempty"`
+	Blocks  int       `json:"blocks,omitempty"`
+	Missing int       `json:"missing,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// runJournal records the actions of the run (dat files opened, read and
+// skipped, listing files created and closed, errors) in an append-only file.
+// Each entry is synced to disk before the run goes on so that the journal
+// tells what was completed when the run is killed or the host crashes.
+type runJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openJournal(file string) (*runJournal, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &runJournal{file: f}, nil
+}
+
+// Record appends e to the journal. Failures are logged but do not stop the
+// run.
+func (j *runJournal) Record(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.When, e.Pid = time.Now().UTC(), os.Getpid()
+	bs, err := json.Marshal(e)
+	if err == nil {
+		_, err = j.file.Write(append(bs, '\n'))
+	}
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		slog.Error("journal not written", "file", j.file.Name(), "event", e.Event, "err", err)
+	}
+}
+
+func (j *runJournal) Event(event, file string) {
+	j.Record(journalEntry{Event: event, File: file})
+}
+
+func (j *runJournal) Error(file string, err error) {
+	if err == nil {
+		return
+	}
+	j.Record(journalEntry{Event: journalError, File: file, Error: err.Error()})
+}
+
+// Closed records the end of the listing file m.
+func (j *runJournal) Closed(m *mvis) {
+	event := journalClose
+	if m.dropped {
+		event = journalDrop
+	}
+	j.Record(journalEntry{
+		Event:   event,
+		File:    m.Name,
+		MD5:     fmt.Sprintf("%x", m.digest.Sum(nil)),
+		Blocks:  m.Blocks,
+		Missing: m.Missing,
+	})
+}
+
+func (j *runJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
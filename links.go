@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	linkSymbolic = "symlink"
+	linkHard     = "hardlink"
+	linkIndex    = "index"
+)
+
+func checkLinkMode(mode string, store storage) error {
+	switch mode {
+	case "", linkIndex:
+		return nil
+	case linkSymbolic, linkHard:
+		if _, ok := store.(localStorage); !ok {
+			return fmt.Errorf("-link-sources %s: listing files are not written on the local disk", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid link mode: %s", mode)
+	}
+}
+
+// linkSources gives access to the dat files used to create the listing file
+// m: links to them in DIR/sources/NAME (where DIR and NAME are the directory
+// and the name of the listing file) or a text file (NAME.sources) giving
+// their paths. Dat files that are not on the local disk can only be indexed.
+func linkSources(m *mvis, mode string) error {
+	if mode == linkIndex {
+		w, err := m.store.Create(m.Name + ".sources")
+		if err != nil {
+			return err
+		}
+		for _, p := range m.sources {
+			if a, err := filepath.Abs(p); err == nil && !isRemote(p) {
+				p = a
+			}
+			if _, err := fmt.Fprintln(w, p); err != nil {
+				abort(w)
+				return err
+			}
+		}
+		return w.Close()
+	}
+	dir := filepath.Join(filepath.Dir(m.Name), "sources", filepath.Base(m.Name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	seen := make(map[string]int)
+	for _, p := range m.sources {
+		if _, _, ok := splitArchive(p); ok || isRemote(p) {
+			slog.Warn("source not linked", "file", p, "listing", m.Name)
+			continue
+		}
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(p)
+		if n := seen[name]; n > 0 {
+			// same name in different directories (eg: -merge)
+			ext := filepath.Ext(name)
+			name = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+		seen[filepath.Base(p)]++
+
+		link := filepath.Join(dir, name)
+		os.Remove(link)
+		if mode == linkHard {
+			err = os.Link(a, link)
+		} else {
+			err = os.Symlink(a, link)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
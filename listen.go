@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// listenAndDump reconstructs listing files from blocks received over the
+// network. addr can be prefixed by the protocol to use (tcp:// or udp://),
+// tcp being the default. The listener and the connection are closed when
+// the run is interrupted: errInterrupted is then returned.
+func listenAndDump(addr, datadir string, opts options) error {
+	proto := "tcp"
+	if ix := strings.Index(addr, "://"); ix >= 0 {
+		proto, addr = addr[:ix], addr[ix+3:]
+	}
+	switch proto {
+	case "tcp":
+		return listenTCP(addr, datadir, opts)
+	case "udp":
+		return listenUDP(addr, datadir, opts)
+	default:
+		return fmt.Errorf("unsupported protocol: %s", proto)
+	}
+}
+
+func listenTCP(addr, datadir string, opts options) error {
+	s, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	x := newInterrupter(opts.signals)
+	x.Add(s)
+	for {
+		c, err := s.Accept()
+		if err != nil {
+			return x.Err(err)
+		}
+		slog.Info("connection", "remote", c.RemoteAddr())
+		x.Add(c)
+		err = dumpFiles(NewStream(x.Reader(c)), datadir, opts)
+		x.Remove(c)
+		c.Close()
+		if errors.Is(err, errInterrupted) {
+			return err
+		}
+		if err != nil {
+			slog.Error("connection failed", "remote", c.RemoteAddr(), "err", err)
+		}
+	}
+}
+
+func listenUDP(addr, datadir string, opts options) error {
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	x := newInterrupter(opts.signals)
+	x.Add(c)
+	return dumpFiles(x.Reader(&packetReader{conn: c}), datadir, opts)
+}
+
+// packetReader gives the blocks received as datagrams. Each datagram should
+// contain one or more complete blocks.
+type packetReader struct {
+	conn   net.PacketConn
+	buffer []byte
+	rest   []byte
+}
+
+func (p *packetReader) Read(bs []byte) (int, error) {
+	for len(p.rest) == 0 {
+		if p.buffer == nil {
+			p.buffer = make([]byte, 64<<10)
+		}
+		n, _, err := p.conn.ReadFrom(p.buffer)
+		if err != nil {
+			return 0, err
+		}
+		if n%LineSize != 0 {
+			slog.Warn("datagram discarded: invalid length", "size", n)
+			continue
+		}
+		p.rest = p.buffer[:n]
+	}
+	n := copy(bs, p.rest)
+	p.rest = p.rest[n:]
+	return n, nil
+}
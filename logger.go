@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// levelTrace is the level of the messages given for each block (-vv).
+const levelTrace = slog.LevelDebug - 4
+
+// tracing reports whether the messages of levelTrace are logged.
+func tracing() bool {
+	return slog.Default().Enabled(context.Background(), levelTrace)
+}
+
+// setupLogger configures the default logger according to the level and the
+// format (text or json) given on the command line.
+func setupLogger(level, format string) error {
+	var lvl slog.Level
+	if level == "trace" {
+		lvl = levelTrace
+	} else if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = &plainHandler{level: lvl, w: os.Stderr, mu: new(sync.Mutex)}
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})
+	default:
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs err and exits.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(exitFailure)
+}
+
+// plainHandler writes one line per record without timestamp: the message
+// followed by its attributes. The level is only given for records that are
+// not informational.
+type plainHandler struct {
+	level slog.Leveler
+	attrs []slog.Attr
+	w     io.Writer
+	mu    *sync.Mutex
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf strings.Builder
+	switch r.Level {
+	case slog.LevelInfo:
+	case levelTrace:
+		buf.WriteString("trace: ")
+	default:
+		buf.WriteString(strings.ToLower(r.Level.String()))
+		buf.WriteString(": ")
+	}
+	buf.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&buf, " %s=%s", a.Key, v)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, buf.String())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	x := *h
+	x.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &x
+}
+
+func (h *plainHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
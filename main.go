@@ -3,28 +3,84 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"hash"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 var FCC = []byte("MMA ")
 
-const (
-	MilFlag   = 0xFFFE
-	FileFlag  = 0xFFFF
-	LineSize  = 64
-	blockSize = (LineSize - 2) * (32 << 10)
+var (
+	// headerLen is the number of bytes following FCC in the header of the
+	// dat files.
+	headerLen = 12
+	// autoFCC is set when any four-char code is accepted as magic.
+	autoFCC bool
+)
+
+// knownFCC gives the length of the header (magic excluded) of the products
+// known. It is used when the magic is auto-detected.
+var knownFCC = map[string]int{
+	"MMA ": 12,
+}
+
+// isFCC reports whether magic is the one expected at the beginning of the dat
+// files. When auto-detected, any four-char code made of upper case letters,
+// digits and spaces is accepted.
+func isFCC(magic []byte) bool {
+	if !autoFCC {
+		return bytes.Equal(magic, FCC)
+	}
+	if len(magic) != len(FCC) {
+		return false
+	}
+	for _, c := range magic {
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == ' ') {
+			return false
+		}
+	}
+	return true
+}
+
+// headerSize gives the length of the header following magic.
+func headerSize(magic []byte) int {
+	if n, ok := knownFCC[string(magic)]; ok && autoFCC {
+		return n
+	}
+	return headerLen
+}
+
+var (
+	// scanHeader is the number of bytes that can precede the header of the
+	// dat files (eg: garbage prepended during transfers).
+	scanHeader int
+	// noHeader is set when dat files start directly with their first block.
+	noHeader bool
+)
+
+var errNoFiles = errors.New("no valid files provided")
+
+// framing of the blocks, set from the decoder of the instrument (see
+// useDecoder).
+var (
+	MilFlag  uint16 = 0xFFFE
+	FileFlag uint16 = 0xFFFF
+	LineSize        = 64
 )
 
 const (
@@ -41,69 +97,1066 @@ const (
 )
 
 const helpText = `mvis2list transforms MVIS data from hadock archive to MVIS
-listing files
+listing files. dat files can be given compressed with gzip or zstd (the zstd
+command should then be available in the PATH). They can also be given as
+s3://bucket/key or http(s):// URLs: they are then read with ranged requests
+without being copied locally first. tar (.tar, .tar.gz, .tgz) and zip archives
+are replaced by the dat files they contain, processed in sorted order (their
+path is then given as archive!entry in the metadata). Quoted glob patterns
+(on the command line or stdin) are expanded by mvis2list itself, ** matching
+any number of directories ('/var/hdk/51/2018/**/*.dat'), to avoid the limit
+on the size of the command line of the shell.
 
 Usage: mvis2list [-datadir] [-version] [-keep] [-meta] <list of dat files>
+       mvis2list COMMAND [options] <arguments>
+
+Commands:
+
+  convert       convert dat files to listing files (same as without command)
+  list          print the list of blocks of dat files (-list)
+  report        print a report on available blocks (-report)
+  verify        compare the listing files that would be created with the
+                existing ones (-verify)
+  batch         convert the dat files of a list of UPI found in the archive
+                (-batch)
+  serve         run an HTTP server accepting conversion jobs (see Daemon mode)
+  diff          compare two listing files (see Listing diff)
+  gen           create synthetic dat files for tests (see Test data)
+  bench         measure the throughput of the conversion (see Benchmark)
+  help COMMAND  print the help of a command
+
+Each command only accepts the options relevant to it. The options replaced
+by commands (-list, -report, -verify, -batch,...) are still supported when no
+command is given.
 
 Options:
 
-  -datadir DIR  base directory where listing files will be written
+  -datadir DIR  base directory where listing files will be written. It can
+                also be a s3://bucket/prefix URL (see -output-url). Files are
+                written as NAME.tmp and renamed to NAME once complete. With
+                -, the listing files are written to stdout (see
+                -stdout-format)
+  -stdout-format FMT
+                how listing files written to stdout are separated: raw
+                (default) concatenates them, header precedes each of them
+                with a line "==> NAME SIZE" (SIZE being the number of bytes
+                that follow the line) and tar writes them as a tar stream
+  -output-url URL
+                write listing files and metadata to object storage instead of
+                the local disk. Supported schemes are s3://bucket/prefix
+                (credentials, region and endpoint taken from AWS_ACCESS_KEY_ID,
+                AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION and
+                AWS_ENDPOINT_URL) and http(s):// (files sent with PUT requests).
+                Large files are sent to S3 with multipart uploads
+  -tar FILE     write all the listing files (and their metadata) in a single
+                tar archive instead of separate files. An index (FILE.idx)
+                gives for each file its offset in the archive, its size and
+                its name (separated by tabs)
   -keep         keep content of bad files when creating listing
-  -meta         create XML metadata file next to listing files
-  -list         print the list of blocks
-  -batch        batch
+  -salvage      use the blocks of bad files only to fill the gaps of the
+                healthy dat file of the same acquisition. Bad files without
+                healthy counterpart are used entirely. The blocks taken from
+                bad files are given in the metadata. Ignored with -keep
+  -pick POLICY  version used when multiple versions of a dat file are found
+                (NAME_1.dat, NAME_2.dat,...): last (default, in the order of
+                the names), largest, newest (modification time) or merge
+                (same as -merge)
+  -merge        merge all the versions of a dat file, including those of other
+                downlinks of the same acquisition given in other directories,
+                instead of only using the last one. Missing blocks of the
+                preferred file (healthy, latest version) are taken from the
+                others. All the files used are listed in the metadata
+  -keep-fill    write the payload of fill blocks (MilFlag) in the listing
+                files (and print them with -list) instead of dropping them.
+                The number of fill blocks is always given in the metadata
+                and the report
+  -bad-report FILE
+                write in FILE (XML) the list of the bad files found during the
+                run with their size, the reason (extension, bad magic or read
+                error) and whether they have been used. Files that can not be
+                read are always skipped
+  -link-sources MODE
+                give access to the dat files used for each listing file:
+                symlink or hardlink creates links to them in
+                DIR/sources/NAME (DIR and NAME being the directory and the
+                name of the listing file), index writes their paths in
+                NAME.sources
+  -retry N      retry N times to open dat files failing to open (except
+                files that do not exist) before giving up. With -retry, files
+                failing while being read are skipped (and reported as bad
+                files) instead of stopping the run
+  -retry-wait DURATION
+                delay between two attempts to open a dat file (default 1s)
+  -continue     keep going when a listing file can not be created, split or
+                closed: the error is logged, the file is marked as failed
+                and the run ends with an error once all the others have been
+                processed. Dat files failing while being read are skipped
+  -rate MBPS    limit the bandwidth used to read the dat files and to write
+                the listing files to MBPS megabytes (1024*1024 bytes) per
+                second, for the reads and writes together
+  -journal      append to DATADIR/.mvis2list-journal (JSON, one line per
+                event, synced to disk) the actions of the run: start and end,
+                dat files opened, fully read (read) and skipped, listing files
+                created, closed (with their md5), dropped and aborted, and the
+                errors. Only for local directories
+  -min-free SIZE
+                keep at least SIZE bytes (suffixes K, M and G can be used) free
+                in the file system of DATADIR (or of the tar archive): the run
+                fails before starting when the size of the dat files does not
+                fit and before creating a listing file whose size (given by
+                its FileFlag block) does not. With -watch, the run is paused
+                until enough space is available instead
+  -quarantine DIR
+                copy in DIR the dat files that can not be decoded (bad magic,
+                read error, garbled data) with a note (NAME.note) describing
+                the failure (files with the same name are copied as NAME.1,
+                NAME.2,...). Files failing while being read are then skipped
+                instead of stopping the run
+  -index FORMAT write next to each listing file an index giving for each block
+                its sequence counter and the offset and size of its payload
+                in the (uncompressed) listing file: csv (NAME.idx.csv, with
+                the dat file of the block) or bin (NAME.idx, records of 12
+                bytes: counter on 2 bytes, offset on 8 and size on 2, big
+                endian)
+  -gaps-map     write next to each listing file a map of its missing blocks
+                (NAME.gaps) to request them again: the magic MVGP, the number
+                of counters in a wrap (2 bytes), the number of wraps of the
+                counter covered (4 bytes), the number of bitmaps (4 bytes)
+                and, for each wrap with missing blocks, its number (4 bytes)
+                and a bitmap with one bit per counter (most significant bit
+                first) set when the block is missing, big endian. Blocks
+                missing at the end (according to the size announced) are
+                included, not those missing before the first block received
+  -meta         create XML metadata file next to listing files. Besides the
+                md5 of the listing file, it gives the md5 of the raw blocks
+                read from the dat files to create it (input-md5)
+  -list         print the list of blocks. The header of each dat file (VMU
+                origin, counter and acquisition time) is printed before its
+                blocks (also with -report)
+  -grep PATTERN with -list or -report, only print the blocks whose payload
+                contains PATTERN, with the listing file and the dat file they
+                belong to. PATTERN is given in hexadecimal when it starts with
+                0x (0xcafe or "0xca fe"), as a string otherwise
+  -show-groups  print the versions of each dat file (also in batch mode) and
+                how they are used instead of converting them: * for the
+                version read, + for a version merged with it (-merge or
+                -salvage), - for a bad file skipped
+  -dump         print the content of each block (like hexdump -C) with its
+                offset, its sequence counter and the missing blocks
+  -batch        batch: convert the dat files found under the archive directory
+                for the UPI listed in a file, one per line. Lines starting
+                with # are ignored. A UPI can contain wildcards (GRIP*) and
+                be followed by a range of dates (GRIP 2018-11-01..2018-11-15,
+                ends inclusive and optional) restricting the files used.
+                Directories of the archive (channel/year/doy/hour/min)
+                outside of these ranges are not visited. An archive split
+                in multiple directories (e.g. one per volume) is given as a
+                comma separated list of directories: their files are
+                processed together, in the order of their acquisition
   -text         stripped null bytes from blocks before writing
-  -report       print a report on available blocks
+  -auto-text    decide for each listing file whether it is a text one (as
+                with -text) from the payload of its first blocks. The
+                decision is given in the metadata (kind)
+  -rules FILE   read from FILE (YAML list or TOML [[rule]] tables) options
+                for the listing files of some UPI (upi: pattern) or whose
+                name matches a pattern (file: pattern). The first rule
+                matching a listing file gives its kind (text: true or false),
+                the subdirectory of DATADIR where it is written (dir), its
+                name (name-template), its compression (compress) and the
+                manifest it is listed in (manifest: md5 or sha256, written in
+                DATADIR). Options not given by the rule are the ones of the
+                command line
+  -text-upi LIST
+                comma separated list of UPI (or glob patterns) whose listing
+                files are text ones. The listing files of the other UPI are
+                binary ones. Implies -auto-text for the files whose UPI is
+                not known
+  -eol EOL      with -text, convert line terminators to lf or crlf (none, the
+                default, keeps them unchanged)
+  -encoding ENC with -text, convert the payload to utf8 or latin1
+  -format FMT   format of the listing files: raw (default) gives the payload
+                of the blocks only, framed gives the sequence counter of each
+                block and the gaps. Framed listing files start with MVL2 and
+                the size of the payload of the blocks (2 bytes) followed by
+                records made of a kind (B for a block, G for missing blocks,
+                F for a fill block), a sequence counter (2 bytes), the length
+                of the data (2 bytes) and the data (payload of the block or
+                number of blocks missing). Integers are big endian
+  -export FMT   with csv, write next to each listing file the lines of its
+                payload as the rows of a CSV file (NAME.csv) giving the
+                sequence counter of the block where the line starts, the
+                number of the line and the line (null bytes removed). Meant
+                for text products
+  -compress ALG compress listing files with gzip or zstd
+  -dry-run      process the blocks but print what would be written instead
+                of creating the listing files
+  -stdin        read the content of dat files from stdin instead of their
+                names
+  -listen ADDR  receive blocks from the network (tcp://host:port or
+                udp://host:port) instead of reading dat files
+  -progress     print the progress of the processing of the dat files
+  -name-template TPL
+                Go template used to name the listing files. Available fields
+                are .UPI, .Name (name found in the stream), .Date (time of
+                the dat file) and .Sequence (number of the file in the run)
+  -tree         write listing files under DATADIR/YYYY/DOY/ according to the
+                time of the dat files
+  -verify       compare the listing files that would be created with the
+                listing files (and metadata) found in DATADIR
+  -stats        print quality figures for each listing file and for the run
+  -min-complete PCT
+                minimum percentage of the blocks of a listing file (95%) that
+                must have been found, the number of blocks expected being
+                given by the size in its FileFlag block. The completeness is
+                given in the metadata
+  -on-incomplete POLICY
+                what to do with the listing files less complete than
+                -min-complete: flag (default) only reports them (in the
+                metadata and the log), partial writes them with the .partial
+                suffix and drop does not write them
+  -reorder N    keep up to N blocks in memory to reorder them according to
+                their sequence counter before writing them
+  -prefer WHICH block to keep (first or last) when blocks with the same
+                sequence counter have a different content
+  -sanitize POLICY
+                what to do with the names of the listing files (given by the
+                dat files) that could escape from DATADIR or are not valid on
+                all systems: replace (default) drops the leading / and the ..
+                elements and replaces the characters not allowed on Windows
+                by _, reject skips the listing file with an error and none
+                uses the names as they are
+  -only LIST    comma separated list of names (or glob patterns) of the
+                files to reconstruct. Other files found in the stream are
+                skipped
+  -seq-from N   only use blocks with a sequence counter greater or equal to N
+  -seq-to N     only use blocks with a sequence counter lower or equal to N
+  -manifest ALG write in DATADIR the list of the listing files created with
+                their md5 (MANIFEST.md5) or sha256 (SHA256SUMS) digest, to
+                be checked with md5sum -c or sha256sum -c
+  -split SIZE   split listing files in parts (name.part1, name.part2,...) of
+                at most SIZE bytes (suffixes K, M and G can be used)
+  -rotate EVERY for listing files received as a continuous stream (-listen,
+                -stdin), close the listing files after EVERY (10m, 1h) and go
+                on in a new file or, with fileflag, close them on each
+                FileFlag block (the listing files received before are done
+                and a repeated listing file starts a new file). Files are
+                named after the time they are created in UTC
+                (name.20181101T120000.000Z). Listing files are rotated when
+                they receive a block
+  -channel LIST in batch and watch modes, only use the dat files of the channels
+                of the comma separated list (51,52): the directories of the
+                other channels of the archive are not visited
+  -include-partial
+                in batch mode, also convert the dat file hadock is still
+                writing (named NAME.dat.rt until finalized) for each channel
+                and UPI, unless its finalized version is already there.
+                Without it, these files are ignored (as in watch mode and by
+                the server, where they are read once finalized). Its last
+                block can be incomplete: it is then dropped
+  -no-upi-dir   in batch mode, do not write listing files of each UPI under
+                DATADIR/UPI/ (the UPI found in the name of the dat files when
+                the UPI list gives a pattern)
+  -incremental  in batch mode, skip the dat files converted by a previous run.
+                Converted files are recorded (with their size and modification
+                time) in DATADIR/.mvis2list-state.json
+  -watch        same as -batch but keep looking for new dat files in the
+                archive and convert them as they arrive
+  -watch-interval DURATION
+                time to wait between two scans of the archive (default 1m)
+  -metrics ADDR expose Prometheus metrics on http://ADDR/metrics (useful with
+                -watch or -listen)
+  -on-conflict POLICY
+                what to do when a listing file already exists: overwrite it
+                (default), skip it, rename the new one (name.1, name.2,...)
+                or stop with an error
+  -verify-before-overwrite
+                when a listing file and its metadata (NAME.xml) already
+                exist, keep the new listing file in memory and only
+                overwrite them if its md5 differs from the one in the
+                metadata. Identical listing files are logged as skipped and
+                left untouched (as well as their metadata), keeping their
+                modification time
+  -on-interrupt POLICY
+                what to do with the listing files still incomplete when the
+                run is interrupted (SIGINT or SIGTERM): keep them (default),
+                delete them or mark them with a name.incomplete file. Complete
+                listing files are always closed (and their metadata written)
+  -report       print a report on available blocks and, for each listing
+                file, the times of the first and last acquisitions of its
+                dat files (given by their directories in the archive). For
+                each dat file, the report gives the number of blocks used,
+                their first and last sequence counters, the blocks missing
+                between it and the previous file and whether it ended with a
+                fill block
+  -validate     check each block for signs of corruption: payload made of
+                zeros only, sequence counter jumping backward or by more than
+                512 blocks (noting when a single bit differs from the counter
+                expected) and, for text listing files (-text and -text-upi),
+                binary data or an entropy too high for text. Suspicious
+                blocks are printed with -list and -report (with a count at the
+                end) and logged when converting
+  -config FILE  read options from a TOML or YAML file. The keys are the names
+                of the options and "args" gives the list of files (or the
+                base directory and the UPI list in batch mode). Options given
+                on the command line override the ones of the file
+  -log-level LEVEL
+                minimum level of the messages to log: trace, debug, info
+                (default), warn or error
+  -quiet        only log errors (same as -log-level error): the listing files
+                created and the missing blocks are not reported
+  -v            also log the dat files read and the details of the listing
+                files closed (same as -log-level debug)
+  -vv           same as -v and also log each block with its sequence counter,
+                its dat file and its listing file (same as -log-level trace)
+  -bytes        print sizes in bytes instead of human units (KiB, MiB, GiB)
+                with -list, -report, -dump and the progress bar
+  -log-format FORMAT
+                format of the messages: text (default) or json
+  -strict       exit with a non zero code when listing files are incomplete
+                or when bad files have been skipped
+  -write-buffer SIZE
+                size of the buffer used when writing listing files (default
+                64K, 0 to disable)
+  -read-buffer SIZE
+                size of the buffer used when reading dat files (default 1M).
+                Use a larger one on network filesystems where small reads
+                are slow
+  -prefetch N   read the next N dat files in memory while the current one is
+                decoded. It hides the latency of network filesystems
+  -max-memory SIZE
+                bound the data kept in memory (listing files waiting to be
+                written to stdout, to a tar archive or to an HTTP server,
+                blocks of the -reorder windows and dat files read ahead with
+                -prefetch). Beyond it, listing files are spilled to temporary
+                files (in TMPDIR), reordering windows are shrunk (blocks are
+                written sooner) and dat files are no longer read ahead
+  -scan-header N
+                search the magic of the dat files in their first N bytes
+                instead of expecting it at the very beginning of the files
+  -no-header    dat files have no header: their first block starts at offset 0
+  -instrument NAME
+                instrument that produced the data (default mvis). It gives
+                the four-char code and the length of the header of the dat
+                files, the size of the blocks and the flags used
+  -fcc CODE     four-char code expected at the beginning of the dat files
+                (default the one of the instrument, "MMA " for mvis). With
+                auto, any code made of upper case letters, digits and spaces
+                is accepted
+  -header-len N number of bytes of the header following the four-char code
+                (default the one of the instrument, or the known length of
+                the code found with -fcc auto)
+  -line-size N  size of the blocks in bytes, counter included (default the
+                one of the instrument, 64 for mvis)
+  -strict-size  stop with an error when the number of bytes written in a
+                listing file (counting missing blocks) does not match the
+                size announced in the stream. Mismatches are otherwise only
+                logged and recorded in the metadata
+  -sparse       preallocate the listing files to the size announced in the
+                stream and leave the missing blocks as holes (read as zeros)
+                so that each block is written at the offset given by its
+                sequence counter. Blocks arriving too late are dropped (see
+                -reorder). The holes and the size of the file are recorded in
+                the metadata. Only for binary listing files written
+                uncompressed in a local directory
+  -catalogue FILE
+                write at the end of the run the metadata (as given by -meta)
+                of all the listing files created in FILE, as XML (FILE.xml)
+                or JSON (FILE.json)
+  -request-file FILE
+                write at the end of the run in FILE a request to send again
+                the blocks missing in the listing files created (gaps and
+                blocks missing at the end), as JSON: for each listing file
+                with missing blocks, its UPI, its channel, the acquisition
+                window of its dat files (from, to), the number of blocks
+                missing and the ranges of sequence counters (first, last,
+                count)
+  -db FILE      record the listing files created (name, UPI, times of the
+                first and last acquisitions, size, md5, blocks, missing
+                blocks and dat files used) in the SQLite database FILE
+                (tables listings and sources), created if needed. Rows are
+                added at the end of each run with the sqlite3 command (that
+                should be available in the PATH)
+  -pg DSN       record each listing file in the PostgreSQL database given by
+                DSN (URL or key=value pairs) as soon as it is complete: the
+                same columns as with -db in the table listings, its dat files
+                in sources and its gaps in gaps. Tables are created (and
+                updated) by mvis2list. Statements are run with the psql
+                command (that should be available in the PATH)
+  -summary FILE write at the end of the run a summary in JSON (stdout for "-")
+                with the listing files produced (blocks, gaps, bytes), the
+                totals, the duration, the exit code and the errors
+  -post-cmd CMD run CMD once each listing file (and its metadata) is written.
+                {file}, {meta} and {name} are replaced in CMD by the path of
+                the listing file, the path of its metadata (empty without
+                -meta) and its name. The command also gets in its
+                environment MVIS2LIST_FILE, MVIS2LIST_META, MVIS2LIST_SIZE
+                (bytes written), MVIS2LIST_MD5, MVIS2LIST_BLOCKS,
+                MVIS2LIST_MISSING and MVIS2LIST_GAPS (FIRST-LAST,...). The
+                run fails when the command fails (see -continue)
+  -notify-url URL
+                POST the summary of the run (JSON, as given by -summary) to
+                URL at the end of the run
+  -notify-smtp HOST:PORT
+                mail the summary of the run with the SMTP server at HOST:PORT
+                to the comma separated list of addresses given by -notify-to
+                (from -notify-from, mvis2list@HOSTNAME by default).
+                Credentials are taken from MVIS2LIST_SMTP_USER and
+                MVIS2LIST_SMTP_PASSWORD when set
+  -notify-missing N
+                only send notifications for the runs that failed, were
+                interrupted or ended with more than N missing blocks
+  -diff         same as the diff command (see below) with the files given
+                as arguments
   -version      print version and exit
   -help         print this text and exit
 
+Daemon mode:
+
+  mvis2list serve [-addr ADDR] [-datadir DIR] [-archive DIR]
+
+  run an HTTP server accepting conversion jobs. Listing files of each job are
+  written under DIR/<job id>. Endpoints:
+
+  POST /jobs                 submit a job: {"files": [...]} (paths in the
+                             archive) or {"upi": [...], "from": TIME, "to":
+                             TIME} to select the dat files from the archive,
+                             with the options "keep", "meta", "text" and
+                             "compress"
+  GET  /jobs                 list the jobs
+  GET  /jobs/ID              status of a job
+  GET  /jobs/ID/files/FILE   download a file produced by a job
+  GET  /metrics              Prometheus metrics
+
+Listing diff:
+
+  mvis2list diff [-text] <old listing> <new listing>
+  mvis2list diff -sources [-keep] [-text] <listing> <list of dat files>
+
+  compare two listing files block by block and print the ranges of blocks
+  (and bytes) whose content differs or that are only in one of the files.
+  When both listing files have an index (written with -index), blocks are
+  matched by their sequence counters and the ranges of sequence counters
+  are printed instead. With -sources, the new listing file is recomputed
+  from the dat files (with its index). The exit code is 5 when the files
+  differ.
+
+Test data:
+
+  mvis2list gen [options] <directory>
+
+  create dat files holding one listing file (NAME, listing.txt by default)
+  spread over FILES dat files (4) of BLOCKS blocks (100), one per minute
+  from START (2018-01-01T00:00:00Z) with a VMU header. The files are named
+  after CHANNEL (51) and UPI (TEST) and written under the layout of the
+  hadock archive with -archive. Defects are added with -gaps N (missing
+  blocks), -duplicates N, -fill N (fill blocks) and -bad N (bad files: a
+  .bad version of N files with all their blocks followed by garbled data).
+  The same -seed (1) always gives the same files.
+
+Benchmark:
+
+  mvis2list bench [-blocks N] [-listing N] [-buffers SIZES] [-text] [-runs N]
+
+  build in memory a stream of N blocks (1000000) holding listing files of
+  -listing blocks (10000) and print, for each buffer size of the
+  comma-separated list SIZES (4K,64K,1M), the throughput of the parsing of
+  the blocks and of the whole conversion (listing files written nowhere),
+  used as read and write buffer (see -read-buffer and -write-buffer). The
+  best of -runs runs (3) is printed. Listing files are text files with
+  -text and sizes are printed in bytes with -bytes. Compare the results of
+  two versions on the same host to spot performance regressions.
+
+Order:
+
+  dat files are processed in the lexicographic order of their names (channel,
+  UPI, acquisition time and version) then of their paths, whatever the order
+  given on the command line, by the file system or by the archive (also in
+  batch and watch modes), and their blocks in the order they have
+  in the files (with -merge and -salvage, the preferred version of each dat
+  file comes first). When blocks have the same sequence counter, the first
+  one found in this order is kept (unless -prefer last). Running again on the
+  same files gives the same listing files and reports.
+
+Exit codes:
+
+  0  all listing files have been created
+  1  processing failed
+  2  invalid usage
+  3  blocks are missing in listing files (with -strict)
+  4  bad files have been skipped (with -strict)
+  5  listing files differ from their sources (with -verify or diff)
+  6  run interrupted by SIGINT or SIGTERM
+
 Examples:
 
 # read dat files from given path and write listing files under /tmp directory
 # without creating the metadata
 $ mvis2list -datadir /tmp /var/hdk/51/2018/23/30/*dat
 
+# same with a pattern matching the files of a whole year, expanded by mvis2list
+$ mvis2list -datadir /tmp '/var/hdk/51/2018/**/*.dat'
+
 # create the list of files to process from a find and write listing files under
 # /tmp directory with XML files next to those
 $ find /var/hdk/51/2018/*dat -type f -name *dat | mvis2list -datadir /tmp -meta
 
 # same as previous but instead of creating listing in file, write them to stdout
-# (meaning of "-" for datadir)
-$ find /var/hdk/51/2018/23/30/*dat -type f -name *dat | mvis2list -datadir -
+# (meaning of "-" for datadir), each of them as an entry of a tar stream
+$ find /var/hdk/51/2018/23/30/*dat -type f -name *dat | mvis2list -datadir - -stdout-format tar | tar tv
+
+# read the content of the dat files directly from stdin
+$ cat /var/hdk/51/2018/23/30/*dat | mvis2list -stdin -datadir /tmp
+
+# name the listing files after their UPI and the date of the dat files
+$ mvis2list -datadir /tmp -name-template '{{.UPI}}_{{.Date.Format "20060102"}}_{{.Name}}' /var/hdk/51/2018/23/30/*dat
+
+# run with options taken from a configuration file such as
+#   datadir = "/tmp"
+#   meta = true
+#   batch = true
+#   args = ["/storage/archives/", "/home/user/upi-285.txt"]
+$ mvis2list -config run.toml
 
 # run with a list of UPI in a flat file
 $ mvis2list -datadir /tmp -meta -zero -batch /storage/archives/ ~/upi-285.txt
+
+# same as previous with an archive split in two volumes
+$ mvis2list -datadir /tmp -meta -batch /vol1/archives,/vol2/archives ~/upi-285.txt
+
+# same as previous but keep converting files as they arrive in the archive
+$ mvis2list -datadir /tmp -meta -watch /storage/archives/ ~/upi-285.txt
 `
 
 func init() {
-	log.SetFlags(0)
+	setupLogger("info", "text")
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, helpText)
-		os.Exit(2)
+		fmt.Fprint(os.Stderr, helpText)
+		os.Exit(exitUsage)
 	}
 }
 
 func main() {
+	cmd, args := findCommand(os.Args[1:])
+	if cmd != nil && cmd.Run != nil {
+		cmd.Run(args)
+		return
+	}
 	datadir := flag.String("datadir", "-", "")
+	outputURL := flag.String("output-url", "", "")
+	tarFile := flag.String("tar", "", "")
 	version := flag.Bool("version", false, "")
 	keep := flag.Bool("keep", false, "")
 	meta := flag.Bool("meta", false, "")
 	list := flag.Bool("list", false, "")
+	dump := flag.Bool("dump", false, "")
+	showVersions := flag.Bool("show-groups", false, "")
 	text := flag.Bool("text", false, "")
 	batch := flag.Bool("batch", false, "")
+	incremental := flag.Bool("incremental", false, "")
 	report := flag.Bool("report", false, "")
-	flag.Parse()
+	compress := flag.String("compress", "", "")
+	dryrun := flag.Bool("dry-run", false, "")
+	stdin := flag.Bool("stdin", false, "")
+	listen := flag.String("listen", "", "")
+	progress := flag.Bool("progress", false, "")
+	naming := flag.String("name-template", "", "")
+	tree := flag.Bool("tree", false, "")
+	verify := flag.Bool("verify", false, "")
+	stats := flag.Bool("stats", false, "")
+	reorder := flag.Int("reorder", 0, "")
+	prefer := flag.String("prefer", preferFirst, "")
+	watch := flag.Bool("watch", false, "")
+	interval := flag.Duration("watch-interval", time.Minute, "")
+	conflict := flag.String("on-conflict", "overwrite", "")
+	verifyOverwrite := flag.Bool("verify-before-overwrite", false, "")
+	strict := flag.Bool("strict", false, "")
+	config := flag.String("config", "", "")
+	noupidir := flag.Bool("no-upi-dir", false, "")
+	split := flag.String("split", "", "")
+	rotateEvery := flag.String("rotate", "", "")
+	gapsMap := flag.Bool("gaps-map", false, "")
+	eol := flag.String("eol", "", "")
+	encoding := flag.String("encoding", "", "")
+	only := flag.String("only", "", "")
+	seqFrom := flag.Int("seq-from", -1, "")
+	seqTo := flag.Int("seq-to", -1, "")
+	manifestAlgo := flag.String("manifest", "", "")
+	metricsAddr := flag.String("metrics", "", "")
+	onInterrupt := flag.String("on-interrupt", interruptKeep, "")
+	strictSize := flag.Bool("strict-size", false, "")
+	sparse := flag.Bool("sparse", false, "")
+	validate := flag.Bool("validate", false, "")
+	flag.BoolVar(&rawBytes, "bytes", false, "")
+	flag.BoolVar(&includePartial, "include-partial", false, "")
+	writeBuffer := flag.String("write-buffer", "64K", "")
+	minFree := flag.String("min-free", "", "")
+	channelList := flag.String("channel", "", "")
+	journaled := flag.Bool("journal", false, "")
+	format := flag.String("format", formatRaw, "")
+	exportFormat := flag.String("export", "", "")
+	autoText := flag.Bool("auto-text", false, "")
+	textUPIs := flag.String("text-upi", "", "")
+	rulesFile := flag.String("rules", "", "")
+	sanitize := flag.String("sanitize", sanitizeReplace, "")
+	minComplete := flag.String("min-complete", "", "")
+	onIncomplete := flag.String("on-incomplete", incompleteFlag, "")
+	stdoutFormat := flag.String("stdout-format", stdoutRaw, "")
+	readBufferSize := flag.String("read-buffer", "1M", "")
+	maxMemory := flag.String("max-memory", "", "")
+	flag.IntVar(&scanHeader, "scan-header", 0, "")
+	flag.BoolVar(&noHeader, "no-header", false, "")
+	instrument := flag.String("instrument", "mvis", "")
+	fcc := flag.String("fcc", "", "")
+	hdrLen := flag.Int("header-len", -1, "")
+	lineSize := flag.Int("line-size", 0, "")
+	badReport := flag.String("bad-report", "", "")
+	flag.BoolVar(&salvageBad, "salvage", false, "")
+	flag.BoolVar(&mergeSets, "merge", false, "")
+	flag.StringVar(&pickPolicy, "pick", pickLast, "")
+	flag.BoolVar(&keepFill, "keep-fill", false, "")
+	diff := flag.Bool("diff", false, "")
+	summaryFile := flag.String("summary", "", "")
+	catalogueFile := flag.String("catalogue", "", "")
+	requestFile := flag.String("request-file", "", "")
+	dbFile := flag.String("db", "", "")
+	pgDSN := flag.String("pg", "", "")
+	notifyURL := flag.String("notify-url", "", "")
+	postCmd := flag.String("post-cmd", "", "")
+	notifySMTP := flag.String("notify-smtp", "", "")
+	notifyFrom := flag.String("notify-from", "", "")
+	notifyTo := flag.String("notify-to", "", "")
+	notifyMissing := flag.Int("notify-missing", -1, "")
+	flag.IntVar(&prefetchFiles, "prefetch", 0, "")
+	linkMode := flag.String("link-sources", "", "")
+	flag.StringVar(&quarantineDir, "quarantine", "", "")
+	indexFormat := flag.String("index", "", "")
+	grep := flag.String("grep", "", "")
+	flag.IntVar(&retryCount, "retry", 0, "")
+	flag.BoolVar(&continueOnError, "continue", false, "")
+	flag.DurationVar(&retryWait, "retry-wait", time.Second, "")
+	rate := flag.Float64("rate", 0, "")
+	level := flag.String("log-level", "info", "")
+	quiet := flag.Bool("quiet", false, "")
+	verbose := flag.Bool("v", false, "")
+	veryVerbose := flag.Bool("vv", false, "")
+	logFormat := flag.String("log-format", "text", "")
+	if cmd != nil {
+		cmd.Setup()
+	}
+	flag.CommandLine.Parse(args)
+	if *config != "" {
+		// options of the configuration file are given before the ones of
+		// the command line so that the latter take precedence.
+		options, files, err := readConfig(*config)
+		if err != nil {
+			fatal(err)
+		}
+		options = append(options, args...)
+		if flag.NArg() == 0 {
+			options = append(options, files...)
+		}
+		flag.CommandLine.Parse(options)
+	}
+	if cmd != nil {
+		cmd.Check()
+	}
+	switch {
+	case *veryVerbose:
+		*level = "trace"
+	case *verbose:
+		*level = "debug"
+	case *quiet:
+		*level = "error"
+	}
+	if err := setupLogger(*level, *logFormat); err != nil {
+		fatal(err)
+	}
+	if *diff {
+		exitDiff(runDiff(flag.Args()))
+	}
 	if *version {
 		fmt.Fprintf(os.Stderr, "%s-%s (%s)\n", Program, Version, BuildTime)
 		os.Exit(2)
 	}
+	if _, err := compressSuffix(*compress); err != nil {
+		fatal(err)
+	}
+	switch *conflict {
+	case conflictSkip, conflictOverwrite, conflictRename, conflictError:
+	default:
+		fatal(fmt.Errorf("invalid conflict policy: %s", *conflict))
+	}
+	switch *onInterrupt {
+	case interruptKeep, interruptDelete, interruptMark:
+	default:
+		fatal(fmt.Errorf("invalid interrupt policy: %s", *onInterrupt))
+	}
+	if *prefer != preferFirst && *prefer != preferLast {
+		fatal(fmt.Errorf("invalid prefer policy: %s", *prefer))
+	}
+	if err := checkText(*eol, *encoding); err != nil {
+		fatal(err)
+	}
+	if err := checkFormat(*format, *eol, *encoding); err != nil {
+		fatal(err)
+	}
+	if err := checkSanitize(*sanitize); err != nil {
+		fatal(err)
+	}
+	if err := checkIncomplete(*onIncomplete); err != nil {
+		fatal(err)
+	}
+	var completeMin float64
+	if *minComplete != "" {
+		v, err := parsePercent(*minComplete)
+		if err != nil {
+			fatal(err)
+		}
+		completeMin = v
+	}
+	if err := useDecoder(*instrument); err != nil {
+		fatal(err)
+	}
+	if err := checkPick(pickPolicy); err != nil {
+		fatal(err)
+	}
+	if includePartial && *watch {
+		fatal(fmt.Errorf("-include-partial can not be used with -watch"))
+	}
+	if mergeSets {
+		pickPolicy = pickMerge
+	}
+	mergeSets = pickPolicy == pickMerge
+	if *channelList != "" {
+		cs, err := parseChannels(*channelList)
+		if err != nil {
+			fatal(err)
+		}
+		channels = cs
+	}
+	switch {
+	case *fcc == "":
+	case *fcc == "auto":
+		autoFCC = true
+	case len(*fcc) == len(FCC):
+		FCC = []byte(*fcc)
+	default:
+		fatal(fmt.Errorf("invalid magic %q: four characters expected", *fcc))
+	}
+	if *hdrLen >= 0 {
+		headerLen = *hdrLen
+	}
+	switch {
+	case *rate < 0:
+		fatal(fmt.Errorf("invalid rate: %g", *rate))
+	case *rate > 0:
+		throttle = newLimiter(*rate)
+	}
+	switch {
+	case *lineSize == 0:
+	case *lineSize < 8:
+		fatal(fmt.Errorf("invalid line size: %d", *lineSize))
+	default:
+		LineSize = *lineSize
+	}
+	var splitSize int
+	if *split != "" {
+		n, err := parseSize(*split)
+		if err != nil {
+			fatal(err)
+		}
+		splitSize = int(n)
+	}
+	var rotating *rotation
+	if *rotateEvery != "" {
+		if splitSize > 0 {
+			fatal(fmt.Errorf("-rotate can not be used with -split"))
+		}
+		r, err := parseRotate(*rotateEvery)
+		if err != nil {
+			fatal(err)
+		}
+		rotating = r
+	}
+	var bufSize int64
+	if *writeBuffer != "0" {
+		n, err := parseSize(*writeBuffer)
+		if err != nil {
+			fatal(err)
+		}
+		bufSize = n
+	}
+	if n, err := parseSize(*readBufferSize); err != nil {
+		fatal(err)
+	} else {
+		readBuffer = int(n)
+	}
+	if *maxMemory != "" {
+		n, err := parseSize(*maxMemory)
+		if err != nil {
+			fatal(err)
+		}
+		memory = &memoryBudget{limit: n}
+	}
+	var tpl *template.Template
+	if *naming != "" {
+		t, err := template.New("name").Parse(*naming)
+		if err != nil {
+			fatal(err)
+		}
+		tpl = t
+	}
+	opts := options{
+		meta:     *meta,
+		text:     *text,
+		compress: *compress,
+		dryrun:   *dryrun,
+		template: tpl,
+		tree:     *tree,
+		conflict: *conflict,
+		reorder:  *reorder,
+		prefer:   *prefer,
+		watch:    *watch,
+		stats:    *stats,
+		total:    new(quality),
+		split:    splitSize,
+		eol:      *eol,
+		encoding: *encoding,
+
+		format:   *format,
+		autoText: *autoText || *textUPIs != "",
+		sanitize: *sanitize,
+
+		minComplete: completeMin,
+		incomplete:  *onIncomplete,
+
+		interrupt:   *onInterrupt,
+		strictSize:  *strictSize,
+		sparse:      *sparse,
+		rotate:      rotating,
+		gapsMap:     *gapsMap,
+		writeBuffer: int(bufSize),
+
+		verifyOverwrite: *verifyOverwrite,
+	}
+	if *seqFrom >= 0 || *seqTo >= 0 {
+		r := seqRange{From: 0, To: counterMask}
+		if *seqFrom >= 0 {
+			r.From = uint16(*seqFrom)
+		}
+		if *seqTo >= 0 {
+			r.To = uint16(*seqTo)
+		}
+		if *seqFrom >= counterLimit || *seqTo >= counterLimit {
+			fatal(fmt.Errorf("sequence counters should be lower than %d", counterLimit))
+		}
+		opts.seqs = &r
+	}
+	if *manifestAlgo != "" {
+		m, err := newManifest(*manifestAlgo)
+		if err != nil {
+			fatal(err)
+		}
+		opts.manifest = m
+	}
+	if *rulesFile != "" {
+		rs, err := readRules(*rulesFile)
+		if err != nil {
+			fatal(err)
+		}
+		rs.Share(opts.manifest)
+		opts.rules = rs
+	}
+	if *textUPIs != "" {
+		for _, p := range strings.Split(*textUPIs, ",") {
+			if _, err := filepath.Match(p, ""); err != nil {
+				fatal(fmt.Errorf("invalid pattern %s: %s", p, err))
+			}
+			opts.textUPIs = append(opts.textUPIs, p)
+		}
+	}
+	if *validate {
+		validation = newValidator(*text, opts.textUPIs)
+	}
+	if *only != "" {
+		for _, p := range strings.Split(*only, ",") {
+			if _, err := filepath.Match(p, ""); err != nil {
+				fatal(fmt.Errorf("invalid pattern %s: %s", p, err))
+			}
+			opts.only = append(opts.only, p)
+		}
+	}
+	if *verify {
+		opts.verify = new(verifier)
+	}
+	var notify *notifier
+	if *notifyURL != "" || *notifySMTP != "" {
+		notify = &notifier{
+			URL:     *notifyURL,
+			SMTP:    *notifySMTP,
+			From:    *notifyFrom,
+			Missing: *notifyMissing,
+		}
+		if *notifySMTP != "" {
+			if *notifyTo == "" {
+				fatal(fmt.Errorf("no recipient given for the notifications (-notify-to)"))
+			}
+			notify.To = strings.Split(*notifyTo, ",")
+			if notify.From == "" {
+				host, _ := os.Hostname()
+				notify.From = Program + "@" + host
+			}
+		}
+	}
+	if *postCmd != "" {
+		h, err := newCommandHook(*postCmd, *meta)
+		if err != nil {
+			fatal(fmt.Errorf("-post-cmd: %w", err))
+		}
+		opts.hooks = append(opts.hooks, h)
+	}
+	if *requestFile != "" && !*dryrun {
+		opts.request = newRetransmission(*requestFile)
+	}
+	if *catalogueFile != "" && !*dryrun {
+		c, err := newCatalogue(*catalogueFile)
+		if err != nil {
+			fatal(err)
+		}
+		opts.catalogue = c
+	}
+	if *dbFile != "" {
+		db, err := openProductDB(*dbFile)
+		if err != nil {
+			fatal(err)
+		}
+		opts.db = db
+	}
+	if *pgDSN != "" {
+		pg, err := openProductPG(*pgDSN)
+		if err != nil {
+			fatal(err)
+		}
+		opts.pg = pg
+	}
+	if *summaryFile != "" || notify != nil {
+		opts.summary = newSummary()
+	}
+	if *outputURL != "" {
+		*datadir = *outputURL
+	}
+	store, dir, err := openStorage(*datadir)
+	if err != nil {
+		fatal(err)
+	}
+	if *datadir == "-" {
+		if store, err = newStdoutStorage(os.Stdout, *stdoutFormat); err != nil {
+			fatal(err)
+		}
+		dir = ""
+	}
+	opts.store, *datadir = store, dir
+	if err := checkLinkMode(*linkMode, store); err != nil {
+		fatal(err)
+	}
+	opts.links = *linkMode
+	if err := checkIndex(*indexFormat); err != nil {
+		fatal(err)
+	}
+	opts.index = *indexFormat
+	if err := checkExport(*exportFormat); err != nil {
+		fatal(err)
+	}
+	opts.export = *exportFormat
+	if *minFree != "" {
+		n, err := parseSize(*minFree)
+		if err != nil {
+			fatal(err)
+		}
+		opts.space = &spaceCheck{Dir: *datadir, Min: n, Wait: *watch}
+		if _, ok := store.(localStorage); !ok {
+			fatal(fmt.Errorf("-min-free can only be used with local directories"))
+		}
+	}
+	if *tarFile != "" && !*dryrun {
+		t, err := newTarStorage(*tarFile)
+		if err != nil {
+			fatal(err)
+		}
+		opts.store, *datadir = t, ""
+		if opts.space != nil {
+			opts.space.Dir = filepath.Dir(*tarFile)
+		}
+	}
+	if opts.sparse {
+		if err := checkSparse(opts); err != nil {
+			fatal(err)
+		}
+		if opts.verifyOverwrite {
+			fatal(fmt.Errorf("-verify-before-overwrite can not be used with -sparse"))
+		}
+	}
+	if *journaled && !*dryrun {
+		if _, ok := opts.store.(localStorage); !ok {
+			fatal(fmt.Errorf("-journal can only be used with local directories"))
+		}
+		if err := os.MkdirAll(*datadir, 0755); err != nil {
+			fatal(err)
+		}
+		if journal, err = openJournal(filepath.Join(*datadir, journalFile)); err != nil {
+			fatal(err)
+		}
+		journal.Record(journalEntry{Event: journalStart, Args: os.Args[1:]})
+	}
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+	if *listen != "" {
+		opts.signals = trapSignals()
+		err := listenAndDump(*listen, *datadir, opts)
+		if errors.Is(err, errInterrupted) {
+			os.Exit(exitInterrupted)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *showVersions {
+		ps := flag.Args()
+		if *batch {
+			set, err := readSet(flag.Arg(1))
+			if err != nil {
+				fatal(err)
+			}
+			ps = archiveFiles(splitRoots(flag.Arg(0)), set)
+		}
+		if err := showGroups(os.Stdout, ps, *keep); err != nil {
+			fatal(err)
+		}
+		return
+	}
 	var (
-		r   *fileReader
-		err error
+		r    io.Reader
+		done *state
 	)
-	if *batch {
-		r, err = NewBatch(flag.Arg(0), flag.Arg(1), *keep)
-	} else {
+	switch {
+	case *stdin:
+		r = NewStream(os.Stdin)
+	case *watch:
+		r, err = NewWatch(flag.Arg(0), flag.Arg(1), *keep, *interval)
+	case *batch:
+		if *incremental {
+			if done, err = loadState(filepath.Join(*datadir, stateFile)); err != nil {
+				fatal(err)
+			}
+		}
+		r, err = NewBatch(flag.Arg(0), flag.Arg(1), *keep, done)
+		if errors.Is(err, errNoFiles) && done != nil {
+			slog.Info("no new dat files to convert")
+			os.Exit(exitOK)
+		}
+	default:
 		ps := flag.Args()
 		if len(ps) == 0 {
 			s := bufio.NewScanner(os.Stdin)
@@ -111,219 +1164,1377 @@ func main() {
 				ps = append(ps, s.Text())
 			}
 			if err := s.Err(); err != nil {
-				log.Fatalln(err)
+				fatal(err)
 			}
 		}
 		r, err = NewReader(ps, *keep)
 	}
 
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
+	}
+	if *dump {
+		if err := hexdumpBlocks(r); err != nil {
+			fatal(err)
+		}
+		return
 	}
 	if *list || *report {
-		if err := listBlocks(r, *list && !*report); err != nil {
-			log.Fatalln(err)
+		pattern, err := parsePattern(*grep)
+		if err != nil {
+			fatal(err)
+		}
+		if err := listBlocks(r, *list && !*report, pattern); err != nil {
+			fatal(err)
 		}
 		return
 	}
-	if err := dumpFiles(r, *datadir, *meta, *text); err != nil {
-		log.Fatalln(err)
+	if u, ok := r.(interface{ UPIs() ([]string, bool) }); ok && !*noupidir {
+		opts.upis, opts.upidir = u.UPIs()
+	}
+	if f, ok := r.(*fileReader); ok && *dryrun {
+		slog.Info("would read", "file", f.Filename())
+		for _, p := range f.ps {
+			slog.Info("would read", "file", p)
+		}
+	}
+	if f, ok := r.(*fileReader); ok && opts.space != nil && !opts.dryrun && opts.verify == nil {
+		// the listing files are at most as large as the dat files
+		size, _, err := f.Size()
+		if err != nil {
+			fatal(err)
+		}
+		if err := opts.space.Reserve(size); err != nil {
+			fatal(err)
+		}
+	}
+	var stop func()
+	if f, ok := r.(*fileReader); ok && *progress {
+		if stop, err = showProgress(f); err != nil {
+			fatal(err)
+		}
+	}
+	opts.signals = trapSignals()
+	if w, ok := r.(*watchReader); ok {
+		w.signals = opts.signals
+	}
+	err = dumpFiles(r, *datadir, opts)
+	if stop != nil {
+		stop()
+	}
+	interrupted := errors.Is(err, errInterrupted)
+	if err != nil && !interrupted {
+		journal.Error("", err)
+		journal.Record(journalEntry{Event: journalEnd, Status: runFailed})
+		// the listing files completed before the failure are kept
+		if e := opts.db.Flush(); e != nil {
+			slog.Error("database not updated", "err", e)
+		}
+		if e := opts.request.WriteFile(); e != nil {
+			slog.Error("retransmission request not written", "err", e)
+		}
+		opts.summary.Error(err)
+		if e := opts.summary.WriteFile(*summaryFile, runFailed, exitFailure); e != nil {
+			slog.Error("summary not written", "err", e)
+		}
+		if e := notify.Notify(opts.summary); e != nil {
+			slog.Error("notification not sent", "err", e)
+		}
+		fatal(err)
+	}
+	if opts.manifest != nil && !opts.dryrun && opts.verify == nil {
+		if err := opts.manifest.WriteFile(opts.store, *datadir); err != nil {
+			fatal(err)
+		}
+	}
+	if !opts.dryrun && opts.verify == nil {
+		if err := opts.rules.WriteManifests(opts.store, *datadir, opts.manifest); err != nil {
+			fatal(err)
+		}
+	}
+	if done != nil && !opts.dryrun && !interrupted {
+		if err := done.Add(r.(*fileReader).Done...); err != nil {
+			fatal(err)
+		}
+		if err := done.Save(); err != nil {
+			fatal(err)
+		}
+	}
+	if c, ok := opts.store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			fatal(err)
+		}
+	}
+	if opts.stats {
+		fmt.Printf("total (%d files): %s\n", opts.total.Files, opts.total)
+	}
+	if err := opts.catalogue.WriteFile(); err != nil {
+		fatal(err)
+	}
+	if err := opts.db.Flush(); err != nil {
+		fatal(err)
+	}
+	if err := opts.request.WriteFile(); err != nil {
+		fatal(err)
+	}
+	if f, ok := r.(*fileReader); ok {
+		if err := reportBadFiles(f.Bad, *badReport); err != nil {
+			fatal(err)
+		}
+		if opts.summary != nil {
+			opts.summary.BadFiles = len(f.Bad)
+		}
+	}
+	status, code := runOK, exitCode(r, opts, *strict)
+	if interrupted {
+		status, code = runInterrupted, exitInterrupted
+	}
+	if err := opts.summary.WriteFile(*summaryFile, status, code); err != nil {
+		fatal(err)
 	}
+	if err := notify.Notify(opts.summary); err != nil {
+		slog.Error("notification not sent", "err", err)
+	}
+	journal.Record(journalEntry{Event: journalEnd, Status: status})
+	journal.Close()
+	os.Exit(code)
 }
 
-func listBlocks(r io.Reader, list bool) error {
+// listBlocks prints the report on the blocks read from r and, with list, the
+// blocks themselves. When a pattern is given, only the blocks whose payload
+// contains it are printed (with the dat file they come from).
+func listBlocks(r io.Reader, list bool, pattern []byte) error {
 	var (
 		prev    uint16
 		missing int
 		count   int
 		size    int
+		matches int
+		fill    int
+	)
+	buf := make([]byte, LineSize)
+	var (
+		name    string
+		names   []string
+		sources = make(map[string][]string)
+		// dat files already parsed (parseSource can stat the file)
+		parsed = make(map[string]source)
+	)
+	named, _ := r.(interface{ Filename() string })
+	headed, _ := r.(interface{ Header() *vmuHeader })
+	filled, _ := r.(interface{ EndedWithFill(string) bool })
+	var (
+		file  string
+		files []*sourceStats
 	)
-	body := make([]byte, LineSize)
-	var name string
 	for {
-		if n, err := io.ReadFull(r, body); err != nil {
+		b, err := nextBlock(r, buf)
+		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
-		} else {
-			size += n
-			count++
 		}
-		s := binary.BigEndian.Uint16(body)
-		if s == FileFlag {
-			size := binary.BigEndian.Uint32(body[2:])
-			name = string(bytes.Trim(body[6:], "\x00"))
-			if list {
-				fmt.Printf("%s (%d bytes)\n", name, size)
+		body := b.Bytes()
+		size += len(body)
+		count++
+		if named != nil && headed != nil && named.Filename() != file {
+			file = named.Filename()
+			if h := headed.Header(); h != nil {
+				fmt.Printf("# %s: %s\n", file, h)
+			}
+		}
+		s := b.Sequence()
+		if b.IsFill() {
+			if list && pattern == nil {
+				fmt.Printf(" fill (%04x): %x\n", body[:2], body[2:])
+			}
+			count--
+			fill++
+			continue
+		}
+		if b.IsFileHeader() {
+			var size int
+			name, size = b.File()
+			if list && pattern == nil {
+				fmt.Printf("%s (%s)\n", name, formatSize(int64(size)))
+			}
+			if _, ok := sources[name]; !ok {
+				names = append(names, name)
+				sources[name] = nil
 			}
 			count--
 			continue
 		}
+		if named != nil {
+			xs, p := sources[name], named.Filename()
+			if len(xs) == 0 || xs[len(xs)-1] != p {
+				sources[name] = append(xs, p)
+			}
+		}
+		if validation != nil {
+			var src source
+			if named != nil {
+				p := named.Filename()
+				var ok bool
+				if src, ok = parsed[p]; !ok {
+					src = parseSource(p)
+					parsed[p] = src
+				}
+			}
+			if rs := validation.Check(name, b, validation.IsText(src.UPI)); len(rs) > 0 {
+				file := "-"
+				if named != nil {
+					file = named.Filename()
+				}
+				fmt.Printf("suspicious %5d (%04x) %s %s: %s\n", s, body[:2], name, file, strings.Join(rs, ", "))
+			}
+		}
+		var gap int
 		if diff := (s - prev) & counterMask; diff != s && diff > 1 {
-			log.Printf("missing blocks (%s): %d (%d - %d)", name, diff-1, prev, s)
+			slog.Warn("missing blocks", "file", name, "count", diff-1, "first", (prev+1)&counterMask, "last", (s-1)&counterMask)
 			missing += int(diff - 1)
+			gap = int(diff - 1)
 		}
 		prev = s
-		if list {
+		if named != nil {
+			p := named.Filename()
+			if len(files) == 0 || files[len(files)-1].File != p {
+				files = append(files, &sourceStats{File: p, First: s, Before: gap})
+			}
+			x := files[len(files)-1]
+			x.Blocks++
+			x.Last = s
+		}
+		switch {
+		case pattern != nil:
+			if !bytes.Contains(b.Payload(), pattern) {
+				break
+			}
+			matches++
+			file := "-"
+			if named != nil {
+				file = named.Filename()
+			}
+			fmt.Printf("%5d (%04x) %s %s: %x\n", s, body[:2], name, file, body[2:])
+		case list:
 			fmt.Printf("%5d (%04x): %x\n", s, body[:2], body[2:])
 		}
 	}
-	fmt.Printf("%d blocks (%d missing), %dKB\n", count, missing, size>>10)
-	return nil
+	fmt.Printf("%d blocks (%d missing), %s\n", count, missing, formatSize(int64(size)))
+	if f, ok := r.(interface{ Fills() int }); ok {
+		fill = f.Fills()
+	}
+	if fill > 0 {
+		fmt.Printf("%d fill blocks\n", fill)
+	}
+	if pattern != nil {
+		fmt.Printf("%d blocks matching %q\n", matches, pattern)
+	}
+	if validation != nil {
+		fmt.Println(validation)
+	}
+	for _, x := range files {
+		if filled != nil {
+			x.Fill = filled.EndedWithFill(x.File)
+		}
+		fmt.Println(x)
+	}
+	for _, n := range names {
+		if a := acquisitionOf(sources[n]); a != nil {
+			fmt.Printf("%s: acquired from %s to %s\n", n, a.Start.Format(time.RFC3339), a.End.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+type options struct {
+	meta     bool
+	text     bool
+	compress string
+	dryrun   bool
+	template *template.Template
+	tree     bool
+	verify   *verifier
+	conflict string
+	stats    bool
+	total    *quality
+	reorder int
+	prefer   string
+	watch    bool
+	upidir   bool
+	upis     []string
+	split    int
+	eol      string
+	encoding string
+	only     []string
+	seqs     *seqRange
+	manifest *manifest
+	store    storage
+	summary  *summary
+	links    string
+	hooks    []hook
+	index    string
+	space    *spaceCheck
+	format   string
+	export   string
+	autoText bool
+	textUPIs []string
+	rules    *ruleSet
+	sanitize string
+
+	minComplete float64
+	incomplete  string
+	catalogue   *catalogue
+	request     *retransmission
+	db          *productDB
+	pg          *productPG
+
+	interrupt  string
+	signals     <-chan os.Signal
+	strictSize  bool
+	sparse      bool
+	rotate      *rotation
+	gapsMap     bool
+	writeBuffer int
+
+	verifyOverwrite bool
+}
+
+// seqRange is a range of sequence counters. When From is greater than To,
+// the range wraps around the counter limit.
+type seqRange struct {
+	From uint16 `xml:"from,attr" json:"from"`
+	To   uint16 `xml:"to,attr" json:"to"`
+}
+
+func (r *seqRange) Contains(s uint16) bool {
+	if r.From <= r.To {
+		return s >= r.From && s <= r.To
+	}
+	return s >= r.From || s <= r.To
+}
+
+// selected reports whether name (or its base name) matches one of the
+// patterns. All names are selected when no pattern is given.
+func selected(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	preferFirst = "first"
+	preferLast  = "last"
+)
+
+// maxOpenFiles is the number of listing files that can be reconstructed at
+// the same time when files are interleaved in the stream. When a new file
+// is found and the limit is reached, the least recently used file is closed.
+const maxOpenFiles = 64
+
+func dumpFiles(r io.Reader, datadir string, opts options) error {
+	var (
+		curr  *mvis
+		files listings
+		count int
+	)
+	named, _ := r.(interface{ Filename() string })
+	salvaged, _ := r.(interface{ Salvaged() bool })
+	filled, _ := r.(interface{ Fills() int })
+	var fills int
+	// with -continue, errors are only fatal for the listing file concerned
+	var failed int
+	fail := func(m *mvis, err error) error {
+		if !continueOnError {
+			// the run stops: the other listing files still open are
+			// incomplete
+			for _, l := range files {
+				if l.mvis != m {
+					l.Abort()
+				}
+			}
+			return err
+		}
+		failed++
+		if m != nil {
+			runMetrics.Error(upiOf(m, opts.upis))
+			err = fmt.Errorf("%s: %w", m.Name, err)
+		}
+		journal.Error("", err)
+		slog.Error("listing failed", "err", err)
+		opts.summary.Error(err)
+		return nil
+	}
+	// rotate closes the listing file curr and goes on in its next part. With
+	// restart, the next part is a new transmission of the listing file: its
+	// sequence counters start again.
+	rotate := func(restart bool) error {
+		next, err := curr.Next(curr.opts)
+		if err != nil {
+			if err := fail(curr, err); err != nil {
+				return err
+			}
+			files.Remove(curr)
+			curr.Abort()
+			curr = nil
+			return nil
+		}
+		if restart {
+			next.last, next.prev, next.started = 0, 0, false
+		}
+		files.Replace(curr, next)
+		if err := closeFile(curr, opts); err != nil {
+			if err := fail(curr, err); err != nil {
+				return err
+			}
+		}
+		curr = next
+		return nil
+	}
+	buf := make([]byte, LineSize)
+	trace := tracing()
+	// interrupt closes the listing files still open when the run is
+	// interrupted, between two blocks or while r waits for the next one.
+	interrupt := func() error {
+		for _, f := range files {
+			if err := interruptFile(f.mvis, opts); err != nil {
+				return err
+			}
+		}
+		return errInterrupted
+	}
+	for {
+		select {
+		case s, ok := <-opts.signals:
+			if ok {
+				slog.Warn("interrupted", "signal", s)
+			}
+			return interrupt()
+		default:
+		}
+		b, err := nextBlock(r, buf)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, errInterrupted) {
+				slog.Warn("interrupted")
+				return interrupt()
+			}
+			return err
+		}
+		body := b.Bytes()
+		if filled != nil {
+			// fill blocks dropped by the reader belong to the listing file
+			// of the blocks around them.
+			if n := filled.Fills(); n > fills && curr != nil {
+				curr.Fills += n - fills
+			}
+			fills = filled.Fills()
+		}
+		sequence := b.Sequence()
+		if b.IsFill() {
+			if curr != nil {
+				if _, err := curr.writeFill(body); err != nil {
+					if err := fail(curr, err); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if b.IsFileHeader() {
+			name, size := b.File()
+			if opts.rotate.OnFileFlag() {
+				// the listing files received before are done
+				for _, l := range slices.Clone(files) {
+					if l.name == name {
+						continue
+					}
+					files.Remove(l.mvis)
+					if err := closeFile(l.mvis, opts); err != nil {
+						if err := fail(l.mvis, err); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if curr = files.Get(name); curr != nil {
+				if opts.rotate.OnFileFlag() {
+					if err := rotate(true); err != nil {
+						return err
+					}
+					if curr == nil {
+						continue
+					}
+				}
+				curr.input.Write(body)
+				continue
+			}
+			if !selected(name, opts.only) {
+				slog.Debug("listing skipped: not selected", "file", name)
+				continue
+			}
+			if m := files.Evict(maxOpenFiles - 1); m != nil {
+				if err := closeFile(m, opts); err != nil {
+					if err := fail(m, err); err != nil {
+						return err
+					}
+				}
+			}
+
+			lopts, dir := opts.rules.Apply(sourceOf(r), name, datadir, opts)
+			kind := "binary"
+			switch {
+			case lopts.text:
+				kind = "text"
+			case lopts.autoText:
+				kind = "auto"
+			}
+			slog.Info("new listing", "file", name, "kind", kind, "size", size, "blocks", size/(LineSize-2))
+			count++
+			if !opts.dryrun && opts.verify == nil {
+				if err := opts.space.Reserve(int64(size)); err != nil {
+					if err := fail(nil, err); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			file, err := listingName(dir, name, sourceOf(r), count, lopts)
+			if err != nil {
+				if err := fail(nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if curr, err = New(file, int(size), lopts); err != nil {
+				if err == errSkip {
+					slog.Info("file skipped: file already exists", "file", file)
+					continue
+				}
+				if err := fail(nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if upi := sourceOf(r).UPI; curr.probing && upi != "" && len(lopts.textUPIs) > 0 {
+				if _, err := curr.setText(isTextUPI(upi, lopts.textUPIs), kindFromUPI); err != nil {
+					if err := fail(curr, err); err != nil {
+						return err
+					}
+				}
+			}
+			curr.input.Write(body)
+			files.Put(name, curr)
+			continue
+		}
+		if curr == nil {
+			continue
+		}
+		if opts.seqs != nil && !opts.seqs.Contains(sequence) {
+			continue
+		}
+		if opts.split > 0 && curr.Len()+LineSize-2 > opts.split || opts.rotate.Due(curr) {
+			if err := rotate(false); err != nil {
+				return err
+			}
+			if curr == nil {
+				continue
+			}
+		}
+		if named != nil {
+			curr.addSource(named.Filename())
+		}
+		if trace && named != nil {
+			slog.Log(context.Background(), levelTrace, "block", "sequence", sequence, "listing", curr.Name, "file", named.Filename())
+		} else if trace {
+			slog.Log(context.Background(), levelTrace, "block", "sequence", sequence, "listing", curr.Name)
+		}
+		if validation != nil {
+			file := "-"
+			if named != nil {
+				file = named.Filename()
+			}
+			validation.Warn(curr, b, file)
+		}
+		if _, err := curr.Write(body); err != nil {
+			// the listing file is incomplete: it must not be found under
+			// its final name
+			files.Remove(curr)
+			curr.Abort()
+			if err := fail(curr, err); err != nil {
+				return err
+			}
+			curr = nil
+			continue
+		}
+		if salvaged != nil && salvaged.Salvaged() {
+			curr.addSalvaged(sequence)
+		}
+		if opts.watch && curr.Complete() {
+			// no end of stream to wait for in watch mode: listing files
+			// are closed as soon as all their blocks have been received.
+			files.Remove(curr)
+			if err := closeFile(curr, opts); err != nil {
+				if err := fail(curr, err); err != nil {
+					return err
+				}
+			}
+			curr = nil
+		}
+	}
+	for len(files) > 0 {
+		m := files[0].mvis
+		files.Remove(m)
+		if err := closeFile(m, opts); err != nil {
+			if err := fail(m, err); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d listing files failed", failed)
+	}
+	return nil
+}
+
+type listing struct {
+	name string
+	*mvis
+}
+
+// listings keeps the listing files being reconstructed ordered from the
+// least recently used to the most recently used.
+type listings []listing
+
+func (ls *listings) Get(name string) *mvis {
+	for i, l := range *ls {
+		if l.name == name {
+			*ls = append(append((*ls)[:i:i], (*ls)[i+1:]...), l)
+			return l.mvis
+		}
+	}
+	return nil
+}
+
+func (ls *listings) Put(name string, m *mvis) {
+	*ls = append(*ls, listing{name: name, mvis: m})
+}
+
+func (ls *listings) Replace(old, m *mvis) {
+	for i, l := range *ls {
+		if l.mvis == old {
+			(*ls)[i].mvis = m
+			return
+		}
+	}
+}
+
+func (ls *listings) Remove(m *mvis) {
+	for i, l := range *ls {
+		if l.mvis == m {
+			*ls = append((*ls)[:i], (*ls)[i+1:]...)
+			return
+		}
+	}
+}
+
+// Evict removes and returns the least recently used listing file if more
+// than limit files are open.
+func (ls *listings) Evict(limit int) *mvis {
+	if len(*ls) <= limit {
+		return nil
+	}
+	m := (*ls)[0].mvis
+	*ls = (*ls)[1:]
+	return m
+}
+
+func closeFile(m *mvis, opts options) error {
+	// a listing file not closed properly is not kept: nothing is recorded
+	// about it
+	if err := m.Close(); err != nil {
+		return err
+	}
+	if m.conv != nil && m.conv.Unprintable > 0 {
+		slog.Warn("non printable characters", "file", m.Name, "count", m.conv.Unprintable)
+	}
+	var err error
+	if c := m.CheckSize(); c.Status != sizeOK {
+		slog.Warn("size mismatch", "file", m.Name, "status", c.Status, "expected", c.Expected, "written", c.Written, "missing", c.Missing)
+		if opts.strictSize {
+			err = fmt.Errorf("%s: size mismatch (%s): %d bytes expected, %d written", m.Name, c.Status, c.Expected, c.Written)
+		}
+	}
+	slog.Debug("listing closed", "file", m.Name, "blocks", m.Blocks, "missing", m.Missing, "gaps", len(m.Gaps), "duplicated", m.Duplicated, "bytes", m.Stats().Written, "sources", len(m.sources))
+	runMetrics.Observe(upiOf(m, opts.upis), m)
+	opts.summary.Add(m)
+	q := qualityOf(m)
+	opts.total.Add(q)
+	if opts.stats {
+		fmt.Printf("%s: %s\n", m.Name, q)
+	}
+	if opts.verify != nil {
+		opts.verify.Verify(m)
+		return err
+	}
+	if opts.dryrun {
+		slog.Info("would write", "file", m.Name, "blocks", m.Blocks, "bytes", m.Stats().Written, "missing", m.Missing)
+		if opts.meta {
+			slog.Info("would write", "file", m.Name+".xml")
+		}
+		return err
+	}
+	if m.dropped {
+		journal.Closed(m)
+		return err
+	}
+	if m.opts.manifest != nil && m.sum != nil {
+		m.opts.manifest.Add(m.Name, m.sum.Sum(nil))
+	}
+	if opts.meta && !m.unchanged {
+		if e := m.WriteMetadata(); e != nil {
+			return e
+		}
+	}
+	if opts.links != "" {
+		if e := linkSources(m, opts.links); e != nil {
+			return e
+		}
+	}
+	journal.Closed(m)
+	if e := opts.catalogue.Add(m); e != nil {
+		return e
+	}
+	opts.request.Add(m, opts.upis)
+	opts.db.Add(m, opts.upis)
+	if e := opts.pg.Add(m, opts.upis); e != nil {
+		return e
+	}
+	for _, h := range opts.hooks {
+		if e := h.Done(m); e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+const (
+	sizeOK    = "ok"
+	sizeShort = "short"
+	sizeLong  = "long"
+)
+
+// sizeCheck compares the size announced in the FileFlag block with the
+// number of bytes written. Missing blocks are counted as if they had been
+// written since they are already reported as gaps. With -sparse, Holes gives
+// the bytes left as holes and Length the size of the listing file. The parts
+// of a split or rotated listing file are not checked: the size announced is
+// the one of the whole listing file.
+type sizeCheck struct {
+	Expected int    `xml:"expected,attr" json:"expected"`
+	Written  int    `xml:"written,attr" json:"written"`
+	Missing  int    `xml:"missing,attr" json:"missing"`
+	Holes    int    `xml:"holes,attr,omitempty" json:"holes,omitempty"`
+	Length   int    `xml:"length,attr,omitempty" json:"length,omitempty"`
+	Status   string `xml:",chardata" json:"status"`
+}
+
+func (m *mvis) CheckSize() sizeCheck {
+	c := sizeCheck{
+		Expected: m.Size,
+		Written:  m.Blocks * (LineSize - 2),
+		Missing:  m.Missing * (LineSize - 2),
+		Status:   sizeOK,
+	}
+	if m.sparse != nil {
+		c.Holes, c.Length = m.Holes, m.Stats().Written
+	}
+	// the last block is padded: up to LineSize-3 bytes can be written in
+	// excess of the expected size.
+	switch got := c.Written + c.Missing; {
+	case m.Size <= 0 || m.opts.split > 0 || m.opts.rotate != nil:
+	case got < m.Size:
+		c.Status = sizeShort
+	case got >= m.Size+LineSize-2:
+		c.Status = sizeLong
+	}
+	return c
+}
+
+type mvis struct {
+	file    io.WriteCloser
+	writer  io.Writer
+	digest  hash.Hash
+	zip     io.WriteCloser
+	raw     *countWriter
+	plain   *countWriter
+
+	Name    string
+	Size    int
+	Blocks  int
+	Missing int
+	Gaps    []gap
+	// byte counters of the blocks written (see Stats)
+	counts listingStats
+
+	// sequence counters of the blocks taken from bad files (-salvage)
+	Salvaged []gap
+
+	Duplicated int
+	Conflicts  int
+	Unordered  int
+	// fill blocks (MilFlag) found among the blocks of the listing file
+	Fills int
+	// bytes left as holes for the missing blocks (-sparse)
+	Holes  int
+	sparse sparseFile
+	// counters of the missing blocks (-gaps-map)
+	gapMap *gapMap
+
+	reorder int
+	pending [][]byte
+	// bytes of pending reserved in the memory budget
+	reserved int64
+	prefer   string
+	held     []byte
+	// with -format framed, the blocks missing before the held block
+	framed  bool
+	gap     *gap
+	// with -auto-text, blocks kept until the kind of the listing file is
+	// decided and where the decision comes from
+	probing  bool
+	probe    []probed
+	kindFrom string
+	eol      string
+	encoding string
+
+	base string
+	part int
+	conv *textWriter
+	buf  *bufio.Writer
+	seqs *seqRange
+	sum  hash.Hash
+	// digest of the raw blocks (FileFlag blocks included) given to the
+	// listing file, as read from the dat files
+	input hash.Hash
+	index *blockIndex
+	// CSV export of the lines of text listing files (-export)
+	export *csvExport
+	// dat file of the last block received
+	source string
+	// options of the listing file (after the rules given with -rules)
+	opts options
+	// completeness checked against -min-complete and whether the listing
+	// file was discarded because of it
+	complete *completeness
+	dropped  bool
+
+	sources []string
+	created time.Time
+	store   storage
+	// md5 of the listing file to overwrite (-verify-before-overwrite) and
+	// whether the new one is the same
+	previous  string
+	unchanged bool
+	text     bool
+	compress string
+
+	prev   uint16
+	last   uint16
+	offset int
+	// whether a block has been written: counters are only compared from
+	// the second one
+	started bool
+}
+
+func New(n string, s int, opts options) (*mvis, error) {
+	return newPart(n, s, 1, opts)
+}
+
+// Next closes nothing but creates the listing file that follows m when the
+// listing is split in multiple parts. The state of the sequence counter is
+// given to the new part so that gaps are still detected across parts.
+func (m *mvis) Next(opts options) (*mvis, error) {
+	if _, err := m.decideText(); err != nil {
+		return nil, err
+	}
+	x, err := newPart(m.base, m.Size, m.part+1, opts)
+	if err != nil {
+		return nil, err
+	}
+	if x.probing {
+		x.setText(m.text, m.kindFrom)
+	}
+	x.last, x.prev, x.started = m.last, m.prev, m.started
+	return x, nil
+}
+
+func newPart(n string, s, part int, opts options) (*mvis, error) {
+	suffix, err := compressSuffix(opts.compress)
+	if err != nil {
+		return nil, err
+	}
+	base := n
+	if opts.split > 0 {
+		n = fmt.Sprintf("%s.part%d", n, part)
+	}
+	created := time.Now()
+	if opts.rotate != nil {
+		n = opts.rotate.Name(n, created)
+	}
+	if opts.verify == nil {
+		if n, err = resolveConflict(opts.store, n, suffix, opts.conflict); err != nil {
+			return nil, err
+		}
+	}
+	n += suffix
+
+	var (
+		w   io.WriteCloser
+		raw = &countWriter{Writer: io.Discard}
+		sum hash.Hash
+		sf  sparseFile
+		old string
+	)
+	if !opts.dryrun && opts.verify == nil {
+		if old = previousSum(n, opts); old != "" {
+			w = createDeferred(opts.store, n)
+		} else if w, err = opts.store.Create(n); err != nil {
+			return nil, err
+		}
+		journal.Event(journalCreate, n)
+		if sf, err = sparseOf(w, s, opts); err != nil {
+			abort(w)
+			return nil, err
+		}
+		raw.Writer = throttledTo(w)
+		if opts.manifest != nil {
+			sum = opts.manifest.New()
+			raw.Writer = io.MultiWriter(raw.Writer, sum)
+		}
+	}
+	z, err := compressWriter(raw, opts.compress)
+	if err != nil {
+		if w != nil {
+			abort(w)
+		}
+		return nil, err
+	}
+	digest := md5.New()
+	plain := &countWriter{Writer: z}
+	m := mvis{
+		Name: n,
+		Size: s,
+		file: w,
+		zip: z,
+		raw: raw,
+		plain: plain,
+		digest: digest,
+		writer: io.MultiWriter(plain, digest),
+		text: opts.text,
+		eol: opts.eol,
+		encoding: opts.encoding,
+		probing: opts.autoText && !opts.text,
+		compress: opts.compress,
+		reorder: opts.reorder,
+		prefer: opts.prefer,
+		seqs: opts.seqs,
+		sum: sum,
+		input: md5.New(),
+		base: base,
+		part: part,
+		store: opts.store,
+		sparse: sf,
+		created: created,
+		previous: old,
+		opts: opts,
+	}
+	if opts.writeBuffer > 0 {
+		// blocks are small: buffer them before they reach the digest, the
+		// compressor and the file to avoid one call (and syscall) per block.
+		m.buf = bufio.NewWriterSize(m.writer, opts.writeBuffer)
+		m.writer = m.buf
+	}
+	if opts.format == formatFramed {
+		// records are written as is: no text conversion is needed since
+		// -eol and -encoding are refused with this format.
+		m.framed = true
+		if _, err := m.writer.Write(framedHeader()); err != nil {
+			if w != nil {
+				abort(w)
+			}
+			return nil, err
+		}
+	} else if opts.text {
+		m.conv = &textWriter{w: m.writer, eol: opts.eol, encoding: opts.encoding}
+		m.writer = m.conv
+	}
+	if opts.gapsMap {
+		m.gapMap = newGapMap()
+	}
+	if opts.index != "" && w != nil {
+		if m.index, err = newIndex(opts.store, n, opts.index); err != nil {
+			abort(w)
+			return nil, err
+		}
+	}
+	if opts.export != "" && w != nil {
+		if m.export, err = newExport(opts.store, n); err != nil {
+			if m.index != nil {
+				m.index.Abort()
+			}
+			abort(w)
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// addSource records that the dat file p gives blocks to the listing file.
+func (m *mvis) addSource(p string) {
+	if p == "" {
+		return
+	}
+	m.source = p
+	for i := len(m.sources) - 1; i >= 0; i-- {
+		if m.sources[i] == p {
+			return
+		}
+	}
+	m.sources = append(m.sources, p)
 }
 
-func dumpFiles(r *fileReader, datadir string, meta, text bool) error {
-	var (
-		curr *mvis
-		err  error
-	)
-	for {
-		body := make([]byte, LineSize)
-		if _, err := io.ReadFull(r, body); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// addSalvaged records that the block with the sequence counter s has been
+// taken from a bad file.
+func (m *mvis) addSalvaged(s uint16) {
+	if n := len(m.Salvaged); n > 0 {
+		if g := &m.Salvaged[n-1]; (g.Last+1)&counterMask == s {
+			g.Last = s
+			g.Count++
+			return
 		}
-		sequence := binary.BigEndian.Uint16(body)
-		if sequence == FileFlag {
-			if curr != nil {
-				curr.Close()
-				if meta {
-					if err := curr.WriteMetadata(); err != nil {
-						return err
-					}
-				}
-			}
-			size := binary.BigEndian.Uint32(body[2:])
-			name := string(bytes.Trim(body[6:], "\x00"))
+	}
+	m.Salvaged = append(m.Salvaged, gap{First: s, Last: s, Count: 1})
+}
 
-			kind := "binary"
-			if text {
-				kind = "text"
-			}
-			log.Printf("==> %s (%s file, %d bytes, %d blocks)", name, kind, size, size/(LineSize-2))
-			if curr, err = New(filepath.Join(datadir, name), int(size), text); err != nil {
-				return err
-			}
-			continue
-		}
-		if curr == nil {
-			continue
-		}
-		if _, err := curr.Write(body); err != nil {
-			log.Printf("error when writing %s: %s", curr.Name, err)
-			curr.Close()
-			curr = nil
-		}
+// Len gives the number of bytes written in the listing file, including the
+// block not yet committed.
+func (m *mvis) Len() int {
+	n := m.raw.Count()
+	if m.buf != nil {
+		n += m.buf.Buffered()
 	}
-	if curr != nil {
-		curr.Close()
-		if meta {
-			if err := curr.WriteMetadata(); err != nil {
-				return err
-			}
-		}
+	if m.held != nil {
+		n += len(m.held) - 2
 	}
-	return nil
+	return n + len(m.probe)*(LineSize-2)
 }
 
-type mvis struct {
-	file    *os.File
-	writer  io.Writer
-	digest  hash.Hash
+// metadata describes a listing file. It is written next to the listing file
+// (-meta) and in the catalogue of the run (-catalogue).
+type metadata struct {
+	XMLName  xml.Name  `xml:"mvis" json:"-"`
+	When     time.Time `xml:"time" json:"time"`
+	Program  string    `xml:"program,attr" json:"program"`
+	Version  string    `xml:"version,attr" json:"version"`
+	Build    string    `xml:"build,attr" json:"build"`
+	File     string    `xml:"filename" json:"filename"`
+	Sum      string    `xml:"md5" json:"md5"`
+	Input    string    `xml:"input-md5" json:"input_md5"`
+	Size     int       `xml:"size" json:"size"`
+	LineSize int       `xml:"line-size" json:"line_size"`
+	Blocks   int       `xml:"blocks" json:"blocks"`
+	Bytes    int       `xml:"bytes" json:"bytes"`
+	Stripped int       `xml:"stripped,omitempty" json:"stripped,omitempty"`
 
-	Name    string
-	Size    int
-	Blocks  int
-	Bytes   int
-	text    bool
+	Format       string       `xml:"format,omitempty" json:"format,omitempty"`
+	Kind         *listingKind `xml:"kind,omitempty" json:"kind,omitempty"`
+	Compression  string       `xml:"compression,omitempty" json:"compression,omitempty"`
+	Compressed   int          `xml:"compressed,omitempty" json:"compressed,omitempty"`
+	Uncompressed int          `xml:"uncompressed,omitempty" json:"uncompressed,omitempty"`
 
-	prev   uint16
-	last   uint16
-	offset int
+	Check       sizeCheck       `xml:"size-check" json:"size_check"`
+	Gaps        []gap           `xml:"gaps>gap" json:"gaps"`
+	Salvaged    *salvagedRanges `xml:"salvaged,omitempty" json:"salvaged,omitempty"`
+	Fills       int             `xml:"fill-blocks" json:"fill_blocks"`
+	Complete    *completeness   `xml:"completeness,omitempty" json:"completeness,omitempty"`
+	Range       *seqRange       `xml:"range,omitempty" json:"range,omitempty"`
+	Acquisition *period         `xml:"acquisition,omitempty" json:"acquisition,omitempty"`
+	Sources     []origin        `xml:"sources>source,omitempty" json:"sources,omitempty"`
 }
 
-func New(n string, s int, txt bool) (*mvis, error) {
-	if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil && !os.IsExist(err) {
-		return nil, err
+// Metadata gives the metadata of the listing file once closed.
+func (m *mvis) Metadata() (*metadata, error) {
+	c := metadata{
+		Check:       m.CheckSize(),
+		Program:     Program,
+		Version:     Version,
+		Build:       BuildTime,
+		When:        time.Now(),
+		File:        m.Name,
+		Size:        m.Size,
+		LineSize:    LineSize,
+		Sum:         fmt.Sprintf("%x", m.digest.Sum(nil)),
+		Input:       fmt.Sprintf("%x", m.input.Sum(nil)),
+		Blocks:      m.Blocks,
+		Bytes:       m.Stats().Data(),
+		Stripped:    m.Stats().Stripped,
+		Gaps:        m.Gaps,
+		Fills:       m.Fills,
+		Complete:    m.complete,
+		Range:       m.seqs,
+		Acquisition: acquisitionOf(m.sources),
 	}
-	w, err := os.Create(n)
-	if err != nil {
-		return nil, err
+	for _, p := range m.sources {
+		o, err := originOf(p)
+		if err != nil {
+			return nil, err
+		}
+		c.Sources = append(c.Sources, o)
 	}
-	// if err := w.Truncate(int64(s)); err != nil {
-	// 	return nil, err
-	// }
-	digest := md5.New()
-	m := mvis{
-		Name: n,
-		Size: s,
-		file: w,
-		digest: digest,
-		writer: io.MultiWriter(w, digest),
-		text: txt,
+	if len(m.Salvaged) > 0 {
+		c.Salvaged = &salvagedRanges{Ranges: m.Salvaged}
 	}
-	return &m, nil
+	if m.framed {
+		c.Format = formatFramed
+	}
+	if m.kindFrom != "" {
+		c.Kind = &listingKind{From: m.kindFrom, Kind: "binary"}
+		if m.text {
+			c.Kind.Kind = "text"
+		}
+	}
+	if m.compress != "" {
+		c.Compression = m.compress
+		c.Compressed = m.Stats().Stored
+		c.Uncompressed = m.Stats().Written
+	}
+	return &c, nil
 }
 
 func (m *mvis) WriteMetadata() error {
 	file := filepath.Join(m.Name+".xml")
 
-	c := struct {
-		XMLName xml.Name  `xml:"mvis"`
-		When    time.Time `xml:"time"`
-		Program string    `xml:"program,attr"`
-		Version string    `xml:"version,attr"`
-		Build   string    `xml:"build,attr"`
-		File    string    `xml:"filename"`
-		Sum     string    `xml:"md5"`
-		Size    int       `xml:"size"`
-		Blocks  int       `xml:"blocks"`
-		Bytes   int       `xml:"bytes"`
-	}{
-		Program: Program,
-		Version: Version,
-		Build:   BuildTime,
-		When:    time.Now(),
-		File:    m.Name,
-		Size:    m.Size,
-		Sum:     fmt.Sprintf("%x", m.digest.Sum(nil)),
-		Blocks:  m.Blocks,
-		Bytes:   m.Bytes,
-	}
-	w, err := os.Create(file)
+	c, err := m.Metadata()
+	if err != nil {
+		return err
+	}
+	w, err := m.store.Create(file)
 	if err != nil {
 		return err
 	}
 
 	e := xml.NewEncoder(w)
 	e.Indent("", "  ")
-	if err := e.Encode(&c); err != nil {
-		w.Close()
-		os.Remove(file)
+	if err := e.Encode(c); err != nil {
+		abort(w)
 		return err
 	}
 	return w.Close()
 }
 
+type gap struct {
+	First uint16 `xml:"first,attr" json:"first"`
+	Last  uint16 `xml:"last,attr" json:"last"`
+	Count int    `xml:"count,attr" json:"count"`
+}
+
+// Complete reports whether all the blocks expected from the size announced
+// in the FileFlag block have been received (or are known to be missing).
+func (m *mvis) Complete() bool {
+	expected := (m.Size + LineSize - 3) / (LineSize - 2)
+	received := m.Blocks + len(m.pending) + len(m.probe)
+	if m.held != nil {
+		received++
+	}
+	return expected > 0 && received+m.Missing >= expected
+}
+
+// Abort discards the listing file.
+func (m *mvis) Abort() {
+	memory.Release(m.reserved)
+	m.reserved = 0
+	m.zip.Close()
+	if m.index != nil {
+		m.index.Abort()
+	}
+	if m.export != nil {
+		m.export.Abort()
+	}
+	if m.file != nil {
+		abort(m.file)
+		journal.Event(journalAbort, m.Name)
+	}
+}
+
 func (m *mvis) Close() error {
 	// if err := m.file.Truncate(int64(m.Bytes)); err != nil {
 	// 	return err
 	// }
+	err := m.flush()
+	if _, e := m.commit(); err == nil {
+		err = e
+	}
+	if _, e := m.decideText(); err == nil {
+		err = e
+	}
+	if m.sparse != nil && err == nil {
+		// the blocks missing at the end are left as holes up to the
+		// size announced
+		err = m.skip(m.Size - int(m.written()))
+	}
+	m.held = nil
+	if m.conv != nil {
+		if e := m.conv.Flush(); err == nil {
+			err = e
+		}
+	}
+	if m.buf != nil {
+		if e := m.buf.Flush(); err == nil {
+			err = e
+		}
+	}
+	if e := m.zip.Close(); err == nil {
+		err = e
+	}
+	if err == nil && m.previous != "" {
+		m.unchanged = m.previous == fmt.Sprintf("%x", m.digest.Sum(nil))
+	}
+	if err == nil && !m.unchanged {
+		err = m.gate()
+	}
+	if m.index != nil {
+		if err != nil || m.dropped || m.unchanged {
+			m.index.Abort()
+		} else {
+			err = m.index.Close()
+		}
+	}
+	if m.export != nil {
+		if err != nil || m.dropped || m.unchanged {
+			m.export.Abort()
+		} else {
+			err = m.export.Close()
+		}
+	}
+	if m.gapMap != nil && m.file != nil && err == nil && !m.dropped && !m.unchanged {
+		err = m.writeGapMap()
+	}
+	if m.file == nil {
+		return err
+	}
+	if err != nil {
+		abort(m.file)
+		return err
+	}
+	if m.unchanged {
+		slog.Info("listing unchanged, skipped", "file", m.Name, "md5", m.previous)
+		return abort(m.file)
+	}
 	return m.file.Close()
 }
 
+// Write writes the payload of a block to the listing file. If a reordering
+// window is set, blocks are kept in memory until the window is full (or the
+// memory budget exhausted) and committed following the order of their
+// sequence counters.
 func (m *mvis) Write(bs []byte) (int, error) {
+	m.input.Write(bs)
+	if m.reorder <= 0 {
+		return m.write(bs)
+	}
+	s := binary.BigEndian.Uint16(bs)
+	if s >= counterLimit {
+		return 0, fmt.Errorf("invalid sequence counter (%d)", s)
+	}
+	m.pending = append(m.pending, append([]byte(nil), bs...))
+	if len(m.pending) <= m.reorder && memory.Grow(int64(len(bs))) {
+		m.reserved += int64(len(bs))
+		return len(bs), nil
+	}
+	m.sortPending()
+	first := m.pending[0]
+	m.pending = m.pending[1:]
+	if _, err := m.write(first); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+// sortPending sorts the blocks waiting in the reordering window according
+// to their distance from the last block written.
+func (m *mvis) sortPending() {
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		pi := binary.BigEndian.Uint16(m.pending[i])
+		pj := binary.BigEndian.Uint16(m.pending[j])
+		return (pi-m.last)&counterMask < (pj-m.last)&counterMask
+	})
+}
+
+func (m *mvis) flush() error {
+	m.sortPending()
+	for _, bs := range m.pending {
+		if _, err := m.write(bs); err != nil {
+			return err
+		}
+	}
+	m.pending = m.pending[:0]
+	memory.Release(m.reserved)
+	m.reserved = 0
+	return nil
+}
+
+func (m *mvis) write(bs []byte) (int, error) {
 	s := binary.BigEndian.Uint16(bs)
 	if s >= counterLimit {
 		return 0, fmt.Errorf("invalid sequence counter (%d)", s)
 	}
-	if s == m.last {
+	if s == m.last && m.started {
+		m.Duplicated++
+		if m.held != nil && !bytes.Equal(m.held[2:], bs[2:]) {
+			m.Conflicts++
+			slog.Warn("conflicting duplicate block", "file", m.Name, "sequence", s)
+			if m.prefer == preferLast {
+				copy(m.held, bs)
+			}
+		}
 		return 0, nil
 	}
-	if diff := (s - m.last) & counterMask; s != diff && diff > 1 {
+	var (
+		missing *gap
+		late    bool
+	)
+	if diff := (s - m.last) & counterMask; m.started && diff > counterLimit/2 {
+		// the counter went backward: block arrived too late
+		m.Unordered++
+		late = true
+		if m.sparse != nil {
+			// its place is already behind: it would be written at the
+			// offset of another block.
+			slog.Warn("late block dropped", "file", m.Name, "sequence", s)
+			return 0, nil
+		}
+	} else if m.started && diff > 1 {
+		m.Missing += int(diff - 1)
+		slog.Warn("missing blocks", "file", m.Name, "count", diff-1, "first", (m.last+1)&counterMask, "last", (s-1)&counterMask)
+		m.Gaps = append(m.Gaps, gap{
+			First: (m.last + 1) & counterMask,
+			Last:  (s - 1) & counterMask,
+			Count: int(diff - 1),
+		})
+		missing = &m.Gaps[len(m.Gaps)-1]
 		// if diff := (s - m.prev) & counterMask; s != diff && diff == 1 {
 		// 	m.offset -= LineSize-2
 		// 	m.Blocks--
@@ -331,211 +2542,443 @@ func (m *mvis) Write(bs []byte) (int, error) {
 		// }
 		// m.offset += int(diff-1) * (LineSize - 2)
 	}
-	m.last, m.prev = s, m.last
-	// n := copy(m.Payload[m.offset:], bs[2:])
+	if !late {
+		m.gapMap.Advance(m.last, s, missing != nil)
+	}
+	m.last, m.prev, m.started = s, m.last, true
+	n, err := m.commit()
+	if err == nil && missing != nil && m.sparse != nil {
+		err = m.skip(missing.Count * len(dec.Payload(bs)))
+	}
+	m.held = append(m.held[:0], bs...)
+	if missing != nil {
+		g := *missing
+		m.gap = &g
+	}
+	return n, err
+}
+
+// commit writes the payload of the last block received. Blocks are kept
+// until the next one arrives so that duplicates can still replace them. With
+// -auto-text, the first blocks are kept until the kind of the listing file is
+// known.
+func (m *mvis) commit() (int, error) {
+	if m.held == nil {
+		return 0, nil
+	}
+	if m.probing {
+		m.probe = append(m.probe, probed{block: append([]byte(nil), m.held...), source: m.source})
+		if len(m.probe) < detectBlocks {
+			return 0, nil
+		}
+		return m.decideText()
+	}
+	return m.emit(m.held, m.source)
+}
+
+// emit writes the payload of the block bs coming from the dat file source.
+func (m *mvis) emit(bs []byte, source string) (int, error) {
+	seq := binary.BigEndian.Uint16(bs)
+	block, payload := bs, dec.Payload(bs)
+	bs = payload
 	if m.text {
-		bs = bytes.TrimRight(bs[2:], "\x00")
-	} else {
-		bs = bs[2:]
+		bs = bytes.TrimRight(bs, "\x00")
+	}
+	if m.export != nil {
+		if err := m.export.Add(seq, bs); err != nil {
+			return 0, err
+		}
+	}
+	if m.framed {
+		var rec []byte
+		if m.gap != nil {
+			rec, m.gap = gapRecord(*m.gap), nil
+		}
+		bs = appendRecord(rec, recordBlock, seq, bs)
 	}
+	at := m.written()
 	if _, err := m.writer.Write(bs); err == nil {
 		m.Blocks++
-		m.Bytes += len(bs)-2
+		m.count(block, payload, bs)
+		if m.index != nil {
+			if err := m.index.Add(seq, at, int(m.written()-at), source); err != nil {
+				return 0, err
+			}
+		}
 		return len(bs), err
 	} else {
 		return 0, err
 	}
 }
 
+// written gives the number of bytes written in the uncompressed listing file,
+// including the ones still buffered.
+func (m *mvis) written() int64 {
+	n := m.plain.Count()
+	if m.buf != nil {
+		n += m.buf.Buffered()
+	}
+	if m.conv != nil {
+		n += len(m.conv.rest)
+	}
+	return int64(n)
+}
+
 type fileReader struct {
 	ps   []string
-	file *os.File
+	file *sourceFile
+
+	Bad  []badFile
+	Done []string
+
+	// bytes read ahead when resynchronizing on a garbled region (or to
+	// check the block following a jump of the counter) and the counter of
+	// the last block read
+	pending []byte
+	seq     uint16
+	synced  bool
+	// last block read and the part of it not yet given by Read
+	frame []byte
+	rest  []byte
+
+	// files used to fill the gaps of dat files (bad files or other
+	// versions) and, for the current file, where its blocks come from
+	pairs  map[string][]string
+	merged []string
+	from   []int
+	block  int
+
+	// dat files whose last block is a fill block and the file of the last
+	// block read when it is one
+	fills map[string]bool
+	fill  string
+	// number of fill blocks read
+	filled int
+
+	batch bool
+	set   []string
+
+	done int64
+	pos  int64
 }
 
-func NewBatch(base, file string, keep bool) (*fileReader, error) {
-	var fs []string
-	switch r, err := os.Open(file); {
-	case err == nil:
-		defer r.Close()
-
-		var set []string
-		s := bufio.NewScanner(r)
-		for s.Scan() {
-			r := s.Text()
-			if strings.HasPrefix(r, "#") || len(r) == 0 {
-				continue
-			}
-			set = append(set, r)
-		}
-		if err := s.Err(); err != nil {
-			return nil, err
-		}
-		if len(set) == 0 {
-			return nil, fmt.Errorf("no upi provided")
-		}
-		fs = walkFiles(base, set)
-	case err != nil && file == "":
-	default:
+// NewBatch creates a reader for the dat files of the UPI listed in file found
+// under base (a comma separated list of roots when the archive is split in
+// multiple directories). Files already converted according to done are
+// ignored.
+func NewBatch(base, file string, keep bool, done *state) (*fileReader, error) {
+	rules, err := readSet(file)
+	if err != nil {
+		return nil, err
+	}
+	ps := walkFiles(splitRoots(base), rules)
+	if done != nil {
+		ps = done.Filter(ps)
+	}
+	r, err := NewReader(ps, keep)
+	if err != nil {
 		return nil, err
 	}
-	return NewReader(fs, keep)
+	r.batch, r.set = true, upiNames(rules)
+	return r, nil
 }
 
-func NewReader(ps []string, keep bool) (*fileReader, error) {
-	sort.Strings(ps)
-	var xs []string
-	for i := 0; i < len(ps); i++ {
-		p := ps[i]
-		if !keep && strings.HasSuffix(p, ".bad") {
+// UPIs gives the set of UPI used to select the files and whether the reader
+// was created in batch mode.
+func (f *fileReader) UPIs() ([]string, bool) {
+	return f.set, f.batch
+}
+
+// readSet reads the list of UPI from file. An empty list is returned when
+// no file is given.
+func readSet(file string) ([]upiRule, error) {
+	if file == "" {
+		return nil, nil
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var set []upiRule
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		r := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(r, "#") || len(r) == 0 {
 			continue
 		}
-		for j := i + 1; j < len(ps); j++ {
-			f := ps[j]
-			ix := strings.LastIndex(f, "_")
-			if ix < 0 {
-				return nil, fmt.Errorf("invalid filename: %s", f)
-			}
-			if !strings.HasPrefix(p, f[:ix]) {
-				xs, i = append(xs, ps[j-1]), j-1
-				break
-			}
+		u, err := parseUPIRule(r)
+		if err != nil {
+			return nil, err
 		}
+		set = append(set, u)
 	}
-	if len(xs) == 0 {
-		return nil, fmt.Errorf("no valid files provided")
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no upi provided")
 	}
-	f, err := openFile(xs[0])
+	return set, nil
+}
+
+func NewReader(ps []string, keep bool) (*fileReader, error) {
+	ps, err := expandPaths(ps)
 	if err != nil {
 		return nil, err
 	}
-	if len(xs) > 1 {
-		xs = xs[1:]
-	} else {
-		xs = xs[:0]
+	sortPaths(ps)
+	xs, pairs, bad := selectVersions(ps, keep)
+	if len(xs) == 0 {
+		return nil, errNoFiles
+	}
+	f := fileReader{ps: xs, Bad: bad, pairs: pairs}
+	// the files of a previous reader are no longer needed
+	prefetch.Stop()
+	prefetch = nil
+	if prefetchFiles > 0 {
+		var order []string
+		for _, x := range xs {
+			order = append(order, x)
+			order = append(order, pairs[x]...)
+		}
+		prefetch = startPrefetch(order, prefetchFiles)
+	}
+	f.openNext()
+	if f.file == nil {
+		return nil, errNoFiles
 	}
+	return &f, nil
+}
 
-	return &fileReader{file: f, ps: xs}, nil
+// Header gives the decoded header of the current dat file, if any.
+func (f *fileReader) Header() *vmuHeader {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.header
 }
 
 func (f *fileReader) Filename() string {
-	return f.file.Name()
+	if f.file == nil {
+		return ""
+	}
+	return f.origin()
+}
+
+// ReadBlock gives the next block of the dat files. Fill blocks are dropped
+// (unless -keep-fill is set) and so are the incomplete blocks found at the end
+// of a dat file. The block is only valid until the next call.
+func (f *fileReader) ReadBlock() (Block, error) {
+	if len(f.frame) != LineSize {
+		f.frame = make([]byte, LineSize)
+	}
+	for f.file != nil {
+		n, err := f.readBlock(f.frame)
+		atomic.StoreInt64(&f.pos, f.done+f.file.Offset())
+		if err != nil && err != io.EOF {
+			if quarantineDir == "" && retryCount == 0 && !continueOnError {
+				return Block{}, err
+			}
+			if err := f.skipFile(err); err != nil {
+				return Block{}, err
+			}
+			continue
+		}
+		if err == nil && n < LineSize {
+			slog.Warn("incomplete block dropped", "file", f.file.Name(), "bytes", n)
+			continue
+		}
+		if err == io.EOF {
+			if f.fill != "" {
+				if f.fills == nil {
+					f.fills = make(map[string]bool)
+				}
+				f.fills[f.fill], f.fill = true, ""
+			}
+			if err := f.file.Close(); err != nil {
+				if quarantineDir == "" && retryCount == 0 && !continueOnError {
+					return Block{}, err
+				}
+				if err := f.skipFile(err); err != nil {
+					return Block{}, err
+				}
+				continue
+			}
+			keepOrigin(f.file)
+			f.done += f.file.Offset()
+			f.Done = append(f.Done, f.file.Name())
+			journal.Event(journalRead, f.file.Name())
+			if err := f.openNext(); err != nil {
+				return Block{}, err
+			}
+			continue
+		}
+		b, _ := parseBlock(f.frame)
+		f.fill = ""
+		if b.IsFill() {
+			f.fill = f.Filename()
+			f.filled++
+			if !keepFill {
+				continue
+			}
+		}
+		return b, nil
+	}
+	return Block{}, io.EOF
 }
 
+// Read copies the blocks given by ReadBlock in bs. Unlike ReadBlock, it can
+// be used with buffers of any size.
 func (f *fileReader) Read(bs []byte) (int, error) {
-	if len(f.ps) == 0 && f.file == nil {
-		return 0, io.EOF
+	if len(f.rest) == 0 {
+		b, err := f.ReadBlock()
+		if err != nil {
+			return 0, err
+		}
+		f.rest = b.Bytes()
 	}
+	n := copy(bs, f.rest)
+	f.rest = f.rest[n:]
+	return n, nil
+}
 
-	n, err := f.file.Read(bs)
-	if p := binary.BigEndian.Uint16(bs); err == nil && p == MilFlag {
-		return 0, nil
+// EndedWithFill reports whether the last block of the dat file p was a fill
+// block.
+func (f *fileReader) EndedWithFill(p string) bool {
+	return f.fills[p]
+}
+
+// Fills gives the number of fill blocks read so far.
+func (f *fileReader) Fills() int {
+	return f.filled
+}
+
+// Position gives the number of bytes already read from the dat files. It
+// can be called while another goroutine is reading.
+func (f *fileReader) Position() int64 {
+	return atomic.LoadInt64(&f.pos)
+}
+
+// Size gives the total number of bytes and the number of dat files to be
+// read.
+func (f *fileReader) Size() (int64, int, error) {
+	var size int64
+	if f.file != nil {
+		i, err := f.file.file.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+		size += i.Size()
 	}
-	if err == io.EOF {
-		if len(f.ps) > 0 {
-			f.file.Close()
-			f.file, err = openFile(f.ps[0])
-			if err != nil {
-				return 0, err
-			}
-			if len(f.ps) == 1 {
-				f.ps = f.ps[:0]
-			} else {
-				f.ps = f.ps[1:]
-			}
-			return 0, nil
-		} else {
-			f.file = nil
+	for _, p := range f.ps {
+		i, err := statRaw(p)
+		if err != nil {
+			return 0, 0, err
 		}
+		size += i.Size()
 	}
-	return n, err
+	return size, len(f.ps) + 1, nil
 }
 
-func openFile(f string) (*os.File, error) {
-	r, err := os.Open(f)
+func openFile(f string) (*sourceFile, error) {
+	r, err := openSource(f)
 	if err != nil {
 		return nil, err
 	}
+	if noHeader {
+		return r, nil
+	}
 	magic := make([]byte, 4)
 	if _, err := r.Read(magic); err != nil {
+		r.Close()
 		return nil, err
 	}
-	if !bytes.Equal(magic, FCC) {
-		return nil, fmt.Errorf("expected magic %s (found: %s)", FCC, magic)
+	var skipped int
+	for !isFCC(magic) && skipped < scanHeader {
+		copy(magic, magic[1:])
+		if _, err := r.Read(magic[len(magic)-1:]); err != nil {
+			r.Close()
+			return nil, err
+		}
+		skipped++
+	}
+	if !isFCC(magic) {
+		r.Close()
+		return nil, fmt.Errorf("%w: expected %s (found: %s)", errBadMagic, FCC, magic)
 	}
-	if _, err := r.Seek(12, io.SeekCurrent); err != nil {
+	if skipped > 0 {
+		slog.Warn("bytes skipped before header", "file", f, "bytes", skipped)
+	}
+	hdr := make([]byte, headerSize(magic))
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		r.Close()
 		return nil, err
 	}
+	if d, ok := dec.(headerDecoder); ok && len(hdr) == dec.HeaderLen() {
+		r.header = d.Header(hdr)
+	}
 	return r, err
 }
 
-func walkFiles(base string, set []string) []string {
+// walkFiles gives the version (see pickVersion) of each dat file found under
+// the roots of the archive for the UPI of set, or all of them to be merged
+// with -pick merge. Files are taken in the order given by sortPaths whatever
+// the order given by the file system.
+func walkFiles(roots []string, set []upiRule) []string {
 	var fs []string
-
-	queue := listFiles(base, set)
-	var p string
-	for {
-		if p == "" {
-			if f, ok := <-queue; ok {
-				p = f
-			} else {
-				return fs
-			}
-		}
-		for {
-			f, ok := <-queue
-			if !ok {
-				return fs
-			}
-			if ix := strings.LastIndex(f, "_"); ix >= 0 {
-				if strings.HasPrefix(p, f[:ix]) {
-					p = f
-					continue
-				}
-				fs = append(fs, p)
-				p = f
-				break
-			} else {
-				p = ""
-			}
+	for _, g := range groupVersions(archiveFiles(roots, set)) {
+		if mergeSets {
+			fs = append(fs, g...)
+		} else {
+			fs = append(fs, pickVersion(g))
 		}
 	}
 	return fs
 }
 
-func listFiles(base string, set []string) <-chan string {
+// archiveFiles gives all the dat files (but the bad ones and the ones still
+// written, see selectRolling) found under the roots of the archive for the
+// UPI of set, sorted by sortPaths.
+func archiveFiles(roots []string, set []upiRule) []string {
+	var ps []string
+	for _, r := range roots {
+		for p := range listFiles(r, set) {
+			ps = append(ps, p)
+		}
+	}
+	sortPaths(ps)
+	return selectRolling(ps)
+}
+
+func listFiles(base string, set []upiRule) <-chan string {
 	q := make(chan string)
 	go func() {
 		defer close(q)
 
-		sort.Strings(set)
-
-		var prefix string
-		filepath.Walk(base, func(p string, i os.FileInfo, err error) error {
-			if err != nil {
-				return err
+		err := walkArchive(base, set, func(p string) {
+			if filepath.Ext(p) == ".bad" {
+				return
 			}
-			if i.IsDir() {
-				return nil
+			// the name of the dat files starts with their channel
+			if ch, _, ok := strings.Cut(filepath.Base(p), "_"); ok && !channelSelected(ch) {
+				return
 			}
-			if filepath.Ext(p) == ".bad" {
-				return nil
-			}
-      if len(set) == 0 || (len(prefix) > 0 && strings.Contains(p, prefix)) {
-        q <- p
-        return nil
-      }
-			base := filepath.Base(p)
-			for _, s := range set {
-				if strings.HasPrefix(base[5:], s) {
+			if len(set) == 0 {
+				q <- p
+				return
+			}
+			for _, u := range set {
+				if u.Match(p) {
 					q <- p
-					prefix = s
 					break
-				} else {
-					prefix = ""
 				}
 			}
-			return nil
 		})
+		if err != nil {
+			slog.Warn("archive not fully walked", "dir", base, "err", err)
+		}
 	}()
 	return q
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"path/filepath"
+	"sort"
+)
+
+// manifest lists the listing files produced during a run with the digest
+// of their content, as found on disk, in the format of md5sum/sha256sum.
+type manifest struct {
+	algo  string
+	files map[string]string
+}
+
+func newManifest(algo string) (*manifest, error) {
+	switch algo {
+	case "md5", "sha256":
+	default:
+		return nil, fmt.Errorf("unsupported manifest digest: %s", algo)
+	}
+	return &manifest{algo: algo, files: make(map[string]string)}, nil
+}
+
+func (m *manifest) New() hash.Hash {
+	if m.algo == "sha256" {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+func (m *manifest) Filename() string {
+	if m.algo == "sha256" {
+		return "SHA256SUMS"
+	}
+	return "MANIFEST.md5"
+}
+
+func (m *manifest) Add(file string, sum []byte) {
+	m.files[file] = fmt.Sprintf("%x", sum)
+}
+
+// WriteFile writes the manifest in datadir. Paths of the listing files are
+// written relative to datadir so that the manifest can be checked from there.
+func (m *manifest) WriteFile(store storage, datadir string) error {
+	var files []string
+	for f := range m.files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	file := filepath.Join(datadir, m.Filename())
+	w, err := store.Create(file)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		rel, err := filepath.Rel(datadir, f)
+		if err != nil {
+			rel = f
+		}
+		if _, err := fmt.Fprintf(w, "%s  %s\n", m.files[f], filepath.ToSlash(rel)); err != nil {
+			abort(w)
+			return err
+		}
+	}
+	return w.Close()
+}
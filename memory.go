@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// memory bounds the data kept in memory by the run (-max-memory): the
+// listing files waiting to be written to stdout, to a tar archive or to an
+// HTTP server, the blocks of the reordering windows and the dat files read
+// ahead. When it is exhausted, listing files are spilled to temporary files
+// (in TMPDIR), reordering windows are shrunk and dat files are no longer
+// read ahead. It is nil when memory is not bounded.
+var memory *memoryBudget
+
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	warn  bool
+}
+
+// Grow reserves n bytes and reports whether they fit in the budget. Nothing
+// is reserved when they don't.
+func (b *memoryBudget) Grow(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		if !b.warn {
+			b.warn = true
+			slog.Warn("memory limit reached", "limit", b.limit, "used", b.used)
+		}
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// Release gives back n bytes reserved with Grow.
+func (b *memoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
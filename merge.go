@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mergeSets is set when all the versions of a dat file, including those of
+// other downlinks of the same acquisition found in other directories, are
+// merged instead of only using the last one (-merge).
+var mergeSets bool
+
+// versionOf gives the version of the dat file p (the number after the last
+// underscore of its name).
+func versionOf(p string) int {
+	p = filepath.Base(p)
+	if ix := strings.LastIndex(p, "_"); ix >= 0 {
+		p = p[ix+1:]
+	}
+	if ix := strings.Index(p, "."); ix >= 0 {
+		p = p[:ix]
+	}
+	v, _ := strconv.Atoi(p)
+	return v
+}
+
+// mergeGroups groups the dat files of ps by acquisition whatever their
+// version and directory. The first value gives the preferred file of each
+// group, ordered by acquisition, and the second the other files of its
+// group ordered by preference: healthy files before bad files and latest
+// versions before earlier ones. Bad files are only merged with -keep or
+// -salvage.
+func mergeGroups(ps []string, keep bool) ([]string, map[string][]string, []badFile) {
+	var (
+		keys   []string
+		bad    []badFile
+		groups = make(map[string][]string)
+	)
+	for _, p := range ps {
+		if isBad(p) && !keep && !salvageBad {
+			bad = append(bad, newBadFile(p, badExtension, nil))
+			continue
+		}
+		k := groupKey(filepath.Base(p))
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], p)
+	}
+	sort.Strings(keys)
+
+	var xs []string
+	pairs := make(map[string][]string)
+	for _, k := range keys {
+		g := groups[k]
+		sort.SliceStable(g, func(i, j int) bool {
+			if bi, bj := isBad(g[i]), isBad(g[j]); bi != bj {
+				return bj
+			}
+			return versionOf(g[i]) > versionOf(g[j])
+		})
+		xs = append(xs, g[0])
+		if len(g) > 1 {
+			pairs[g[0]] = g[1:]
+		}
+	}
+	return xs, pairs, bad
+}
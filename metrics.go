@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metrics keeps counters, by UPI, about the listing files produced since the
+// program started. They are exposed in the Prometheus text format.
+type metrics struct {
+	mu       sync.Mutex
+	counters map[string]map[string]int64
+}
+
+var runMetrics = &metrics{counters: make(map[string]map[string]int64)}
+
+var metricsHelp = []struct {
+	Name string
+	Help string
+}{
+	{"mvis2list_files_total", "Number of listing files produced."},
+	{"mvis2list_blocks_written_total", "Number of blocks written in listing files."},
+	{"mvis2list_blocks_missing_total", "Number of blocks missing in listing files."},
+	{"mvis2list_bytes_written_total", "Number of bytes written in listing files."},
+	{"mvis2list_errors_total", "Number of errors while producing listing files."},
+}
+
+func (m *metrics) add(name, upi string, v int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	vs, ok := m.counters[name]
+	if !ok {
+		vs = make(map[string]int64)
+		m.counters[name] = vs
+	}
+	vs[upi] += v
+}
+
+// Observe updates the counters with the figures of a closed listing file.
+func (m *metrics) Observe(upi string, x *mvis) {
+	m.add("mvis2list_files_total", upi, 1)
+	m.add("mvis2list_blocks_written_total", upi, int64(x.Blocks))
+	m.add("mvis2list_blocks_missing_total", upi, int64(x.Missing))
+	m.add("mvis2list_bytes_written_total", upi, int64(x.Stats().Stored))
+}
+
+func (m *metrics) Error(upi string) {
+	m.add("mvis2list_errors_total", upi, 1)
+}
+
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for _, h := range metricsHelp {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", h.Name, h.Help, h.Name)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		vs := m.counters[h.Name]
+		upis := make([]string, 0, len(vs))
+		for u := range vs {
+			upis = append(upis, u)
+		}
+		sort.Strings(upis)
+		for _, u := range upis {
+			n, err := fmt.Fprintf(w, "%s{upi=%q} %d\n", h.Name, u, vs[u])
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// serveMetrics exposes the metrics on /metrics in background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", runMetrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+}
+
+// upiOf gives the UPI of the first dat file used to reconstruct m.
+func upiOf(m *mvis, set []string) string {
+	if len(m.sources) == 0 {
+		return ""
+	}
+	return parseSource(m.sources[0]).MatchUPI(set)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// source describes a dat file from the information available in its path.
+// When the path does not give the time of the file, its modification time
+// is used instead.
+// The hadock archive stores the files under channel/year/doy/hour/min and
+// the name of the files starts with a 4 characters prefix followed by the
+// UPI, the time of the acquisition (year_doy_hour_min) and the version of
+// the file.
+type source struct {
+	Path    string
+	Channel string
+	UPI     string
+	Time    time.Time
+	// acquisition time given by the path of the file in the archive (zero
+	// when Time is the modification time of the file)
+	Acquired time.Time
+}
+
+func parseSource(p string) source {
+	s := source{Path: p}
+	if p == "" {
+		return s
+	}
+	if a, e, ok := splitArchive(p); ok {
+		p = filepath.Join(filepath.Dir(a), e)
+	}
+	base := filepath.Base(p)
+	if ix := strings.Index(base, "."); ix >= 0 {
+		base = base[:ix]
+	}
+	if ix := strings.LastIndex(base, "_"); ix >= 5 {
+		s.UPI = trimAcquisition(base[5:ix])
+	}
+	parts := strings.Split(filepath.ToSlash(filepath.Dir(p)), "/")
+	for i, x := range parts {
+		year, err := strconv.Atoi(x)
+		if err != nil || len(x) != 4 {
+			continue
+		}
+		when := []int{1, 0, 0}
+		for j := 0; j < len(when) && i+j+1 < len(parts); j++ {
+			v, err := strconv.Atoi(parts[i+j+1])
+			if err != nil {
+				break
+			}
+			when[j] = v
+		}
+		s.Time = time.Date(year, 1, when[0], when[1], when[2], 0, 0, time.UTC)
+		if i > 0 {
+			s.Channel = parts[i-1]
+		}
+		break
+	}
+	s.Acquired = s.Time
+	if s.Time.IsZero() {
+		if i, err := statRaw(s.Path); err == nil {
+			s.Time = i.ModTime().UTC()
+		}
+	}
+	return s
+}
+
+// trimAcquisition removes the time of the acquisition (year_doy_hour_min)
+// found at the end of the name of the dat files.
+func trimAcquisition(upi string) string {
+	parts := strings.Split(upi, "_")
+	if len(parts) < 5 {
+		return upi
+	}
+	for i, n := range []int{4, 3, 2, 2} {
+		x := parts[len(parts)-4+i]
+		if _, err := strconv.Atoi(x); err != nil || len(x) != n {
+			return upi
+		}
+	}
+	return strings.Join(parts[:len(parts)-4], "_")
+}
+
+// MatchUPI gives the UPI of set the source belongs to. The UPI found in the
+// name of the file is returned if none of set matches or if the matching
+// entry of set is a pattern: without the time of the acquisition, it is the
+// same for all the dat files of the UPI.
+func (s source) MatchUPI(set []string) string {
+	for _, u := range set {
+		if matchUPI(u, s.UPI) {
+			if strings.ContainsAny(u, "*?[") {
+				break
+			}
+			return u
+		}
+	}
+	return s.UPI
+}
+
+// sourceOf gives the dat file currently read by r if r reads dat files.
+func sourceOf(r interface{}) source {
+	f, ok := r.(interface{ Filename() string })
+	if !ok {
+		return source{}
+	}
+	return parseSource(f.Filename())
+}
+
+// outputName gives the path of the listing file for the file name found
+// in the FileFlag block, using the naming template if one is given.
+func outputName(datadir, name string, src source, seq int, opts options) (string, error) {
+	if opts.upidir {
+		if upi := src.MatchUPI(opts.upis); upi != "" {
+			datadir = filepath.Join(datadir, upi)
+		}
+	}
+	if opts.tree {
+		when := src.Time
+		if when.IsZero() {
+			when = time.Now().UTC()
+		}
+		datadir = filepath.Join(datadir, fmt.Sprintf("%04d", when.Year()), fmt.Sprintf("%03d", when.YearDay()))
+	}
+	if opts.template == nil {
+		return filepath.Join(datadir, name), nil
+	}
+	d := struct {
+		UPI      string
+		Name     string
+		Date     time.Time
+		Sequence int
+	}{
+		UPI:      src.UPI,
+		Name:     name,
+		Date:     src.Time,
+		Sequence: seq,
+	}
+	var buf bytes.Buffer
+	if err := opts.template.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return filepath.Join(datadir, buf.String()), nil
+}
+
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictError     = "error"
+)
+
+var errSkip = errors.New("skip")
+
+// resolveConflict gives the name to use for a listing file according to the
+// conflict policy when a file with the same name already exists.
+func resolveConflict(store storage, n, suffix, policy string) (string, error) {
+	if !store.Exists(n + suffix) {
+		return n, nil
+	}
+	switch policy {
+	case conflictSkip:
+		return "", errSkip
+	case conflictError:
+		return "", fmt.Errorf("%s: file already exists", n+suffix)
+	case conflictRename:
+		for i := 1; ; i++ {
+			x := fmt.Sprintf("%s.%d", n, i)
+			if !store.Exists(x + suffix) {
+				return x, nil
+			}
+		}
+	default:
+		return n, nil
+	}
+}
+
+// origin describes a dat file used to reconstruct a listing file.
+type origin struct {
+	Channel string `xml:"channel,attr,omitempty" json:"channel,omitempty"`
+	UPI     string `xml:"upi,attr,omitempty" json:"upi,omitempty"`
+	Time    string `xml:"time,attr,omitempty" json:"time,omitempty"`
+
+	// header of the dat file
+	Origin  string `xml:"vmu-origin,attr,omitempty" json:"vmu_origin,omitempty"`
+	Counter string `xml:"vmu-counter,attr,omitempty" json:"vmu_counter,omitempty"`
+	VMUTime string `xml:"vmu-time,attr,omitempty" json:"vmu_time,omitempty"`
+
+	Size    int64     `xml:"size,attr" json:"size"`
+	ModTime time.Time `xml:"mtime,attr" json:"mtime"`
+	Sum     string    `xml:"md5,attr" json:"md5"`
+	Path    string    `xml:",chardata" json:"path"`
+}
+
+// origins keeps the description of the dat files computed while they were
+// read so that the metadata of the listing files does not read them again.
+var origins = struct {
+	sync.Mutex
+	files map[string]origin
+}{files: make(map[string]origin)}
+
+// keepOrigin records the description of the dat file s once it has been read
+// to the end and closed.
+func keepOrigin(s *sourceFile) {
+	if s.digest == nil {
+		return
+	}
+	o, err := s.origin()
+	if err != nil {
+		return
+	}
+	origins.Lock()
+	defer origins.Unlock()
+	origins.files[o.Path] = o
+}
+
+// originOf describes the dat file p. Files not (completely) read yet are
+// read once to compute their checksum.
+func originOf(p string) (origin, error) {
+	origins.Lock()
+	o, ok := origins.files[p]
+	origins.Unlock()
+	if ok {
+		return o, nil
+	}
+	r, err := openFile(p)
+	if err != nil {
+		// without a header that can be decoded
+		if r, err = openSource(p); err != nil {
+			return origin{Path: p}, err
+		}
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		r.Close()
+		return origin{Path: p}, err
+	}
+	if err := r.Close(); err != nil {
+		return origin{Path: p}, err
+	}
+	return r.origin()
+}
+
+// origin describes the dat file s. Its checksum is only known once the whole
+// file went through the reader.
+func (s *sourceFile) origin() (origin, error) {
+	p := s.Name()
+	src := parseSource(p)
+	o := origin{
+		Path:    p,
+		Channel: src.Channel,
+		UPI:     src.UPI,
+	}
+	if !src.Acquired.IsZero() {
+		o.Time = src.Acquired.Format(time.RFC3339)
+	}
+	if h := s.header; h != nil {
+		o.Origin = fmt.Sprintf("0x%02x", h.Origin)
+		o.Counter = strconv.FormatUint(uint64(h.Counter), 10)
+		o.VMUTime = h.Time.Format(time.RFC3339Nano)
+	}
+	i, err := statRaw(p)
+	if err != nil {
+		return o, err
+	}
+	o.Size, o.ModTime = i.Size(), i.ModTime().UTC()
+	if s.raw.n != o.Size {
+		return o, fmt.Errorf("%s: %d bytes read out of %d", p, s.raw.n, o.Size)
+	}
+	o.Sum = fmt.Sprintf("%x", s.digest.Sum(nil))
+	return o, nil
+}
+
+// period is the time range covered by the acquisitions of the dat files
+// used for a listing file.
+type period struct {
+	Start time.Time `xml:"start,attr" json:"start"`
+	End   time.Time `xml:"end,attr" json:"end"`
+}
+
+// acquisitionOf gives the times of the first and last acquisitions of the
+// dat files of ps according to their path in the archive. It is nil when
+// none of them is found in a dated directory.
+func acquisitionOf(ps []string) *period {
+	var a *period
+	for _, p := range ps {
+		t := parseSource(p).Acquired
+		switch {
+		case t.IsZero():
+		case a == nil:
+			a = &period{Start: t, End: t}
+		case t.Before(a.Start):
+			a.Start = t
+		case t.After(a.End):
+			a.End = t
+		}
+	}
+	return a
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifier sends the summary of the run to a webhook (-notify-url) and/or by
+// mail (-notify-smtp). With a threshold (-notify-missing), only the runs that
+// did not end well or with more missing blocks than the threshold are
+// notified.
+type notifier struct {
+	URL     string
+	SMTP    string
+	From    string
+	To      []string
+	Missing int
+}
+
+func (n *notifier) Wanted(s *summary) bool {
+	return n.Missing < 0 || s.Status != runOK || s.Missing > n.Missing
+}
+
+// Notify sends s to all the destinations configured. All of them are tried
+// even if one fails.
+func (n *notifier) Notify(s *summary) error {
+	if n == nil || s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !n.Wanted(s) {
+		return nil
+	}
+	var err error
+	if n.URL != "" {
+		err = n.post(s)
+	}
+	if n.SMTP != "" {
+		if e := n.mail(s); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (n *notifier) post(s *summary) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	c := http.Client{Timeout: 30 * time.Second}
+	rs, err := c.Post(n.URL, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	defer rs.Body.Close()
+	if rs.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s: notification refused (%s)", n.URL, rs.Status)
+	}
+	return nil
+}
+
+// mail sends s by mail. The credentials used to authenticate to the server
+// are taken from MVIS2LIST_SMTP_USER and MVIS2LIST_SMTP_PASSWORD when set.
+func (n *notifier) mail(s *summary) error {
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.subject(s))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: application/json; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(bs, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if u := os.Getenv("MVIS2LIST_SMTP_USER"); u != "" {
+		host, _, err := net.SplitHostPort(n.SMTP)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", u, os.Getenv("MVIS2LIST_SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(n.SMTP, auth, n.From, n.To, msg.Bytes())
+}
+
+func (n *notifier) subject(s *summary) string {
+	return fmt.Sprintf("%s: run %s (%d listing files, %d blocks missing, %d errors)", s.Program, s.Status, len(s.Files), s.Missing, len(s.Errors))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// pgMigrations are the changes of the schema of the PostgreSQL database, in
+// order. The version of the schema (number of migrations applied) is kept in
+// the table mvis2list_schema: only the missing migrations are applied. New
+// changes are appended, existing ones are never modified.
+var pgMigrations = []string{
+	`CREATE TABLE listings (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		upi TEXT,
+		acquired_from TIMESTAMPTZ,
+		acquired_to TIMESTAMPTZ,
+		size BIGINT,
+		bytes BIGINT,
+		md5 TEXT,
+		blocks INTEGER,
+		missing INTEGER,
+		created TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX listings_name ON listings(name)`,
+	`CREATE INDEX listings_upi ON listings(upi)`,
+	`CREATE TABLE sources (
+		listing BIGINT NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		path TEXT NOT NULL
+	)`,
+	`CREATE TABLE gaps (
+		listing BIGINT NOT NULL REFERENCES listings(id) ON DELETE CASCADE,
+		first INTEGER NOT NULL,
+		last INTEGER NOT NULL,
+		count INTEGER NOT NULL
+	)`,
+}
+
+// productPG records each listing file in a PostgreSQL database (-pg) as soon
+// as it is complete, with the dat files it was built from and its gaps. The
+// statements are run with the psql command (that should be available in the
+// PATH). The DSN is given to psql as is (URL or key=value pairs).
+type productPG struct {
+	dsn string
+}
+
+func openProductPG(dsn string) (*productPG, error) {
+	if _, err := exec.LookPath("psql"); err != nil {
+		return nil, fmt.Errorf("-pg: psql command not found: %w", err)
+	}
+	pg := productPG{dsn: dsn}
+	return &pg, pg.migrate()
+}
+
+// migrate applies the migrations missing in the database in a transaction.
+func (pg *productPG) migrate() error {
+	var sql strings.Builder
+	sql.WriteString("BEGIN;\n")
+	sql.WriteString("CREATE TABLE IF NOT EXISTS mvis2list_schema (version INTEGER NOT NULL);\n")
+	sql.WriteString("LOCK TABLE mvis2list_schema;\n")
+	for i, m := range pgMigrations {
+		fmt.Fprintf(&sql, `DO $$ BEGIN
+IF NOT EXISTS (SELECT 1 FROM mvis2list_schema WHERE version >= %[1]d) THEN
+	EXECUTE %[2]s;
+	INSERT INTO mvis2list_schema (version) VALUES (%[1]d);
+END IF;
+END $$;
+`, i+1, sqlText(m))
+	}
+	sql.WriteString("COMMIT;\n")
+	if err := pg.exec(sql.String()); err != nil {
+		return fmt.Errorf("-pg: schema not updated: %w", err)
+	}
+	return nil
+}
+
+// Add records the listing file m with its sources and its gaps in a single
+// statement.
+func (pg *productPG) Add(m *mvis, upis []string) error {
+	if pg == nil {
+		return nil
+	}
+	var from, to string
+	if a := acquisitionOf(m.sources); a != nil {
+		from, to = a.Start.Format(time.RFC3339), a.End.Format(time.RFC3339)
+	}
+	var sql strings.Builder
+	fmt.Fprintf(&sql, "WITH l AS (INSERT INTO listings (name, upi, acquired_from, acquired_to, size, bytes, md5, blocks, missing) VALUES (%s, %s, %s, %s, %d, %d, %s, %d, %d) RETURNING id)",
+		sqlText(m.Name), sqlText(upiOf(m, upis)), sqlText(from), sqlText(to), m.Size, m.Stats().Written, sqlText(fmt.Sprintf("%x", m.digest.Sum(nil))), m.Blocks, m.Missing)
+	if len(m.sources) > 0 {
+		vs := make([]string, len(m.sources))
+		for i, p := range m.sources {
+			vs[i] = "(" + sqlText(p) + ")"
+		}
+		fmt.Fprintf(&sql, ", s AS (INSERT INTO sources (listing, path) SELECT l.id, v.path FROM l, (VALUES %s) AS v(path))", strings.Join(vs, ", "))
+	}
+	if len(m.Gaps) > 0 {
+		vs := make([]string, len(m.Gaps))
+		for i, g := range m.Gaps {
+			vs[i] = fmt.Sprintf("(%d, %d, %d)", g.First, g.Last, g.Count)
+		}
+		fmt.Fprintf(&sql, ", g AS (INSERT INTO gaps (listing, first, last, count) SELECT l.id, v.first, v.last, v.count FROM l, (VALUES %s) AS v(first, last, count))", strings.Join(vs, ", "))
+	}
+	sql.WriteString(" SELECT id FROM l;\n")
+	if err := pg.exec(sql.String()); err != nil {
+		return fmt.Errorf("%s: not recorded in the database: %w", m.Name, err)
+	}
+	return nil
+}
+
+func (pg *productPG) exec(sql string) error {
+	cmd := exec.Command("psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-o", os.DevNull, "-f", "-", pg.dsn)
+	cmd.Stdin = strings.NewReader(sql)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
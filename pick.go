@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// policies to choose the version of a dat file used when multiple versions of
+// the same acquisition are found (-pick)
+const (
+	pickLast    = "last"
+	pickLargest = "largest"
+	pickNewest  = "newest"
+	pickMerge   = "merge"
+)
+
+// pickPolicy is the policy used to choose the version of each dat file.
+var pickPolicy = pickLast
+
+// groupVersions groups the versions of the same dat files: files whose paths
+// only differ by their version (the number after the last underscore of their
+// names and the extensions). Groups are given in the order of their first
+// file in ps and the files of a group keep their order. A file without version
+// is a group on its own.
+func groupVersions(ps []string) [][]string {
+	var (
+		groups [][]string
+		index  = make(map[string]int)
+	)
+	for _, p := range ps {
+		k := groupKey(p)
+		if i, ok := index[k]; ok {
+			groups[i] = append(groups[i], p)
+			continue
+		}
+		index[k] = len(groups)
+		groups = append(groups, []string{p})
+	}
+	return groups
+}
+
+// selectVersions gives the dat files to read among ps (sorted by sortPaths)
+// and the files merged with them, one per group of versions unless -merge
+// is set. Without keep, bad files are never chosen but only merged with
+// -salvage and -merge: the others are given as bad files.
+func selectVersions(ps []string, keep bool) ([]string, map[string][]string, []badFile) {
+	if mergeSets {
+		return mergeGroups(ps, keep)
+	}
+	var (
+		xs    []string
+		bad   []badFile
+		bads  []string
+		pairs map[string][]string
+	)
+	for _, g := range groupVersions(ps) {
+		if !keep {
+			var good []string
+			for _, p := range g {
+				switch {
+				case !isBad(p):
+					good = append(good, p)
+				case salvageBad:
+					bads = append(bads, p)
+				default:
+					bad = append(bad, newBadFile(p, badExtension, nil))
+				}
+			}
+			if g = good; len(g) == 0 {
+				continue
+			}
+		}
+		xs = append(xs, pickVersion(g))
+	}
+	if len(bads) > 0 {
+		var alone []string
+		pairs, alone = pairBadFiles(xs, bads)
+		// nothing healthy to compare them with: bad files fill the gap
+		// left in the archive entirely.
+		xs = append(xs, alone...)
+		sortPaths(xs)
+	}
+	return xs, pairs, bad
+}
+
+// showGroups prints the groups of versions of the dat files ps (-show-groups)
+// and how each file is used: * for the file read, + for a file merged with
+// it (-merge and -salvage), - for a bad file skipped.
+func showGroups(w io.Writer, ps []string, keep bool) error {
+	ps, err := expandPaths(ps)
+	if err != nil {
+		return err
+	}
+	sortPaths(ps)
+	xs, pairs, bad := selectVersions(ps, keep)
+
+	marks := make(map[string]string)
+	for _, x := range xs {
+		marks[x] = "*"
+		for _, p := range pairs[x] {
+			marks[p] = "+"
+		}
+	}
+	for _, b := range bad {
+		marks[b.Path] = "-"
+	}
+	for _, g := range groupVersions(ps) {
+		fmt.Fprintf(w, "%s (%d versions)\n", groupKey(g[0]), len(g))
+		for _, p := range g {
+			m, ok := marks[p]
+			if !ok {
+				m = " "
+			}
+			fmt.Fprintf(w, "  %s %s\n", m, p)
+		}
+	}
+	return nil
+}
+
+func checkPick(policy string) error {
+	switch policy {
+	case pickLast, pickLargest, pickNewest, pickMerge:
+		return nil
+	default:
+		return fmt.Errorf("unsupported pick policy: %s", policy)
+	}
+}
+
+// pickVersion gives the version of a dat file to use among the versions of
+// group, in the order given by sortPaths: the last one, the largest or the
+// most recently modified. When the size or the modification time of the
+// files are the same (or can not be known), the last of them is used.
+func pickVersion(group []string) string {
+	best := group[len(group)-1]
+	if pickPolicy != pickLargest && pickPolicy != pickNewest || len(group) == 1 {
+		return best
+	}
+	var (
+		found bool
+		size  int64
+		mtime time.Time
+	)
+	for _, p := range group {
+		i, err := statRaw(p)
+		if err != nil {
+			slog.Warn("version ignored", "file", p, "err", err)
+			continue
+		}
+		switch {
+		case !found:
+		case pickPolicy == pickLargest && i.Size() < size:
+			continue
+		case pickPolicy == pickNewest && i.ModTime().Before(mtime):
+			continue
+		}
+		best, size, mtime, found = p, i.Size(), i.ModTime(), true
+	}
+	return best
+}
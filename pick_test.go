@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupVersions(t *testing.T) {
+	data := []struct {
+		Name  string
+		Files []string
+		Want  [][]string
+	}{
+		{
+			Name: "empty",
+		},
+		{
+			Name:  "single",
+			Files: []string{"51/0051_TEST_2018_001_00_00_1.dat"},
+			Want:  [][]string{{"51/0051_TEST_2018_001_00_00_1.dat"}},
+		},
+		{
+			Name:  "single bad",
+			Files: []string{"51/0051_TEST_2018_001_00_00_2.dat.bad"},
+			Want:  [][]string{{"51/0051_TEST_2018_001_00_00_2.dat.bad"}},
+		},
+		{
+			Name: "versions",
+			Files: []string{
+				"51/0051_TEST_2018_001_00_00_1.dat",
+				"51/0051_TEST_2018_001_00_00_2.dat.bad",
+				"51/0051_TEST_2018_001_00_01_1.dat",
+			},
+			Want: [][]string{
+				{"51/0051_TEST_2018_001_00_00_1.dat", "51/0051_TEST_2018_001_00_00_2.dat.bad"},
+				{"51/0051_TEST_2018_001_00_01_1.dat"},
+			},
+		},
+		{
+			Name: "trailing group",
+			Files: []string{
+				"51/0051_TEST_2018_001_00_00_1.dat",
+				"51/0051_TEST_2018_001_00_01_1.dat",
+				"51/0051_TEST_2018_001_00_01_2.dat",
+				"51/0051_TEST_2018_001_00_01_3.dat.bad",
+			},
+			Want: [][]string{
+				{"51/0051_TEST_2018_001_00_00_1.dat"},
+				{"51/0051_TEST_2018_001_00_01_1.dat", "51/0051_TEST_2018_001_00_01_2.dat", "51/0051_TEST_2018_001_00_01_3.dat.bad"},
+			},
+		},
+		{
+			Name: "unordered",
+			Files: []string{
+				"51/0051_TEST_2018_001_00_00_2.dat",
+				"51/0051_TEST_2018_001_00_01_1.dat",
+				"51/0051_TEST_2018_001_00_00_1.dat",
+			},
+			Want: [][]string{
+				{"51/0051_TEST_2018_001_00_00_2.dat", "51/0051_TEST_2018_001_00_00_1.dat"},
+				{"51/0051_TEST_2018_001_00_01_1.dat"},
+			},
+		},
+		{
+			Name:  "without underscore",
+			Files: []string{"a.dat", "b.dat", "a.dat"},
+			Want:  [][]string{{"a.dat", "a.dat"}, {"b.dat"}},
+		},
+		{
+			Name:  "underscore in directories",
+			Files: []string{"dir_1/a.dat", "dir_2/b.dat"},
+			Want:  [][]string{{"dir_1/a.dat"}, {"dir_2/b.dat"}},
+		},
+	}
+	for _, d := range data {
+		got := groupVersions(d.Files)
+		if !reflect.DeepEqual(got, d.Want) {
+			t.Errorf("%s: groups mismatch: want %q, got %q", d.Name, d.Want, got)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// prefetchFiles is the number of dat files read ahead in memory while the
+// current one is decoded (-prefetch). It hides the latency of network
+// filesystems.
+var prefetchFiles int
+
+// prefetch gives the dat files read ahead, if any.
+var prefetch *prefetcher
+
+type prefetched struct {
+	data []byte
+	info os.FileInfo
+	err  error
+	// bytes reserved in the memory budget
+	reserved int64
+}
+
+func (p prefetched) release() {
+	memory.Release(p.reserved)
+}
+
+// errNoMemory is given for the files not read ahead because they don't fit
+// in the memory budget (-max-memory).
+var errNoMemory = errors.New("not enough memory")
+
+// prefetcher reads dat files in the background in the order they will be
+// opened, keeping at most n of them in memory.
+type prefetcher struct {
+	mu    sync.Mutex
+	index map[string]int
+	files []chan prefetched
+	next  int
+	slots chan struct{}
+	// stop ends the reads in the background, done is closed once they are
+	// over
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startPrefetch(ps []string, n int) *prefetcher {
+	p := prefetcher{
+		index: make(map[string]int),
+		slots: make(chan struct{}, n),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	var todo []string
+	for _, x := range ps {
+		// entries of archives are read from a shared cursor: they are
+		// left to the reader.
+		if _, _, ok := splitArchive(x); ok {
+			continue
+		}
+		if _, ok := p.index[x]; !ok {
+			p.index[x] = len(todo)
+			p.files = append(p.files, make(chan prefetched, 1))
+			todo = append(todo, x)
+		}
+	}
+	go func() {
+		defer close(p.done)
+		for i, x := range todo {
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.stop:
+				return
+			}
+			p.files[i] <- readAhead(x)
+		}
+	}()
+	return &p
+}
+
+// Stop ends the reads in the background and releases the files read ahead
+// that have not been taken. The files not read ahead yet are left to the
+// reader.
+func (p *prefetcher) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.files[p.next:] {
+		select {
+		case r := <-c:
+			<-p.slots
+			r.release()
+		default:
+		}
+	}
+}
+
+// receive gives the dat file i once read ahead, unless the prefetcher has
+// been stopped before.
+func (p *prefetcher) receive(i int) (prefetched, bool) {
+	select {
+	case r := <-p.files[i]:
+		<-p.slots
+		return r, true
+	case <-p.done:
+	}
+	select {
+	case r := <-p.files[i]:
+		<-p.slots
+		return r, true
+	default:
+		return prefetched{}, false
+	}
+}
+
+func readAhead(p string) prefetched {
+	f, err := openThrottled(p)
+	if err != nil {
+		return prefetched{err: err}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return prefetched{err: err}
+	}
+	if !memory.Grow(info.Size()) {
+		return prefetched{err: errNoMemory}
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		memory.Release(info.Size())
+		return prefetched{err: err}
+	}
+	return prefetched{data: data, info: info, reserved: info.Size()}
+}
+
+// Take gives the content of the dat file x if it has been prefetched. The
+// files read ahead before x that have not been taken are dropped. Files
+// that could not be read ahead are left to the reader to report the error.
+func (p *prefetcher) Take(x string) (rawFile, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i, ok := p.index[x]
+	if !ok || i < p.next {
+		return nil, false
+	}
+	for ; p.next < i; p.next++ {
+		if r, ok := p.receive(p.next); ok {
+			r.release()
+		}
+	}
+	p.next++
+	r, ok := p.receive(i)
+	if !ok || r.err != nil {
+		return nil, false
+	}
+	f := entryFile{
+		Reader: bytes.NewReader(r.data),
+		name:   x,
+		info:   r.info,
+		close: func() error {
+			r.release()
+			return nil
+		},
+	}
+	return &f, true
+}
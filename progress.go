@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const barWidth = 40
+
+// showProgress prints on stderr how many bytes of the dat files have been
+// processed until the returned function is called.
+func showProgress(r *fileReader) (func(), error) {
+	total, count, err := r.Size()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("files to process", "count", count, "bytes", total)
+
+	var (
+		done  = make(chan struct{})
+		over  = make(chan struct{})
+		start = time.Now()
+	)
+	go func() {
+		defer close(over)
+
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				printProgress(total, r.Position(), start)
+				fmt.Fprintln(os.Stderr)
+				return
+			case <-tick.C:
+				printProgress(total, r.Position(), start)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-over
+	}, nil
+}
+
+func printProgress(total, pos int64, start time.Time) {
+	if total <= 0 {
+		return
+	}
+	if pos > total {
+		pos = total
+	}
+	var (
+		ratio   = float64(pos) / float64(total)
+		elapsed = time.Since(start)
+		rate    = float64(pos) / elapsed.Seconds()
+		eta     time.Duration
+	)
+	if rate > 0 {
+		eta = time.Duration(float64(total-pos)/rate) * time.Second
+	}
+	n := int(ratio * barWidth)
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", barWidth-n)
+	fmt.Fprintf(os.Stderr, "\r[%s] %5.1f%% %10s/s ETA %s ", bar, ratio*100, formatSize(int64(rate)), eta.Truncate(time.Second))
+}
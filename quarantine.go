@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quarantineDir is the directory where the dat files that can not be decoded
+// are copied with a note describing the failure (-quarantine).
+var quarantineDir string
+
+var quarantined = struct {
+	sync.Mutex
+	files map[string]struct{}
+}{files: make(map[string]struct{})}
+
+// quarantine copies the dat file p in the quarantine directory with a note
+// (p.note) giving the reason of its quarantine. Files are only copied once.
+// A file with the same name as one already in quarantine (from another
+// directory) is renamed with a numeric suffix (p.1, p.2,...).
+func quarantine(p, reason string, cause error) {
+	if quarantineDir == "" {
+		return
+	}
+	quarantined.Lock()
+	defer quarantined.Unlock()
+	if _, ok := quarantined.files[p]; ok {
+		return
+	}
+	quarantined.files[p] = struct{}{}
+
+	file := quarantineName(filepath.Join(quarantineDir, filepath.Base(p)))
+	if err := copyRaw(p, file); err != nil {
+		slog.Error("file not quarantined", "file", p, "err", err)
+		return
+	}
+	note := fmt.Sprintf("file: %s\nreason: %s\nerror: %s\ntime: %s\nprogram: %s %s\n", p, reason, cause, time.Now().UTC().Format(time.RFC3339), Program, Version)
+	if err := os.WriteFile(file+".note", []byte(note), 0644); err != nil {
+		slog.Error("file not quarantined", "file", p, "err", err)
+		return
+	}
+	slog.Info("file quarantined", "file", p, "reason", reason, "to", file)
+}
+
+// quarantineName gives the first name available for file in the quarantine
+// directory.
+func quarantineName(file string) string {
+	x := file
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(x); os.IsNotExist(err) {
+			return x
+		}
+		x = fmt.Sprintf("%s.%d", file, i)
+	}
+}
+
+func copyRaw(p, file string) error {
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+	r, err := openDirect(p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// skipFile gives up the current dat file after err occurred while it was
+// read: the file is recorded as bad, quarantined and the next one is opened.
+func (f *fileReader) skipFile(err error) error {
+	p := f.file.Name()
+	slog.Warn("file skipped", "file", p, "reason", badRead, "err", err)
+	f.Bad = append(f.Bad, newBadFile(p, badRead, err))
+	journal.Record(journalEntry{Event: journalSkip, File: p, Error: err.Error()})
+	quarantine(p, badRead, err)
+
+	f.done += f.file.Offset()
+	f.file.Close()
+	f.file, f.pending = nil, nil
+	return f.openNext()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttle limits the bandwidth used to read the dat files and to write the
+// listing files (-rate). There is no limit when it is nil.
+var throttle *limiter
+
+// limiter spreads the transfers of bytes so that their average rate stays
+// under a limit. It is shared by all the readers and writers of the run.
+type limiter struct {
+	mu    sync.Mutex
+	rate  float64
+	start time.Time
+	n     int64
+}
+
+// newLimiter gives a limiter of rate MB (1024*1024 bytes) per second.
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate * (1 << 20)}
+}
+
+// Wait blocks until n more bytes can be transferred. Pauses (waiting for new
+// dat files for example) do not give credit for later bursts.
+func (l *limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.start.IsZero() || now.Sub(l.due()) > time.Second {
+		l.start, l.n = now, 0
+	}
+	l.n += int64(n)
+	due := l.due()
+	l.mu.Unlock()
+	if d := due.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (l *limiter) due() time.Time {
+	return l.start.Add(time.Duration(float64(l.n) / l.rate * float64(time.Second)))
+}
+
+type throttledWriter struct {
+	io.Writer
+}
+
+func (t throttledWriter) Write(bs []byte) (int, error) {
+	throttle.Wait(len(bs))
+	return t.Writer.Write(bs)
+}
+
+type throttledFile struct {
+	rawFile
+}
+
+func (t throttledFile) Read(bs []byte) (int, error) {
+	n, err := t.rawFile.Read(bs)
+	throttle.Wait(n)
+	return n, err
+}
+
+// openThrottled opens the dat file p limited by throttle.
+func openThrottled(p string) (rawFile, error) {
+	f, err := openDirect(p)
+	if err != nil || throttle == nil {
+		return f, err
+	}
+	return throttledFile{f}, nil
+}
+
+// throttledTo gives w limited by throttle (or w itself without limit).
+func throttledTo(w io.Writer) io.Writer {
+	if throttle == nil {
+		return w
+	}
+	return throttledWriter{w}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteChunkSize is the number of bytes requested at once when a dat file
+// is read from a remote location.
+const remoteChunkSize = 4 << 20
+
+// rawFile is a dat file opened either from the local disk or from a remote
+// location (s3:// or http(s):// URL).
+type rawFile interface {
+	io.ReadCloser
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+func isRemote(p string) bool {
+	return strings.Contains(p, "://")
+}
+
+// openRaw opens the dat file p limited by throttle. Files read ahead have
+// already been throttled when read.
+func openRaw(p string) (rawFile, error) {
+	if f, ok := prefetch.Take(p); ok {
+		return f, nil
+	}
+	return openThrottled(p)
+}
+
+func openOnce(p string) (rawFile, error) {
+	if _, _, ok := splitArchive(p); ok {
+		return openEntry(p)
+	}
+	if !isRemote(p) {
+		return os.Open(p)
+	}
+	f, err := openRemote(p)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func statRaw(p string) (os.FileInfo, error) {
+	if _, _, ok := splitArchive(p); ok {
+		return statEntry(p)
+	}
+	if !isRemote(p) {
+		return os.Stat(p)
+	}
+	f, err := openRemote(p)
+	if err != nil {
+		return nil, err
+	}
+	return f.Stat()
+}
+
+// remoteFile reads a remote dat file with successive ranged requests.
+type remoteFile struct {
+	name  string
+	size  int64
+	mtime time.Time
+	pos   int64
+	start int64
+	whole bool
+	body  io.ReadCloser
+	get   func(method string, header http.Header) (*http.Response, error)
+}
+
+func openRemote(p string) (*remoteFile, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	f := remoteFile{name: p}
+	switch u.Scheme {
+	case "s3":
+		s, err := newS3Storage(&url.URL{Scheme: u.Scheme, Host: u.Host})
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		f.get = func(method string, header http.Header) (*http.Response, error) {
+			return s.do(method, key, nil, header, nil)
+		}
+	case "http", "https":
+		f.get = func(method string, header http.Header) (*http.Response, error) {
+			req, err := http.NewRequest(method, p, nil)
+			if err != nil {
+				return nil, err
+			}
+			for k, vs := range header {
+				req.Header[k] = vs
+			}
+			rs, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			if rs.StatusCode/100 != 2 {
+				rs.Body.Close()
+				return nil, fmt.Errorf("%s %s: %s", method, p, rs.Status)
+			}
+			return rs, nil
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported input scheme", u.Scheme)
+	}
+	rs, err := f.get(http.MethodHead, nil)
+	if err != nil {
+		return nil, err
+	}
+	rs.Body.Close()
+	f.size = rs.ContentLength
+	f.mtime, _ = http.ParseTime(rs.Header.Get("Last-Modified"))
+	return &f, nil
+}
+
+func (f *remoteFile) Name() string {
+	return f.name
+}
+
+func (f *remoteFile) Stat() (os.FileInfo, error) {
+	return remoteInfo{f}, nil
+}
+
+func (f *remoteFile) Read(bs []byte) (int, error) {
+	if f.body == nil {
+		if err := f.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(bs)
+	f.pos += int64(n)
+	if err == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if !f.whole && f.pos-f.start == remoteChunkSize && (f.size < 0 || f.pos < f.size) {
+			err = nil
+		}
+		if n == 0 && err == nil {
+			return f.Read(bs)
+		}
+	}
+	return n, err
+}
+
+// fetch requests the next chunk of the file. Servers ignoring the Range
+// header send the complete file: the part already read is then skipped.
+func (f *remoteFile) fetch() error {
+	if f.whole || (f.size >= 0 && f.pos >= f.size) {
+		return io.EOF
+	}
+	f.start = f.pos
+	rg := fmt.Sprintf("bytes=%d-%d", f.pos, f.pos+remoteChunkSize-1)
+	rs, err := f.get(http.MethodGet, http.Header{"Range": {rg}})
+	if err != nil {
+		return err
+	}
+	switch rs.StatusCode {
+	case http.StatusPartialContent:
+		cr := rs.Header.Get("Content-Range")
+		if ix := strings.LastIndex(cr, "/"); ix >= 0 {
+			if n, err := strconv.ParseInt(cr[ix+1:], 10, 64); err == nil {
+				f.size = n
+			}
+		}
+	default:
+		if _, err := io.CopyN(io.Discard, rs.Body, f.pos); err != nil {
+			rs.Body.Close()
+			return err
+		}
+		f.whole = true
+	}
+	f.body = rs.Body
+	return nil
+}
+
+func (f *remoteFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+type remoteInfo struct {
+	*remoteFile
+}
+
+func (r remoteInfo) Name() string       { return path.Base(r.name) }
+func (r remoteInfo) Size() int64        { return r.size }
+func (r remoteInfo) Mode() os.FileMode  { return 0444 }
+func (r remoteInfo) ModTime() time.Time { return r.mtime }
+func (r remoteInfo) IsDir() bool        { return false }
+func (r remoteInfo) Sys() any           { return nil }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retransmission gathers the blocks missing in the listing files created
+// during the run (-request-file) and writes them at the end as a request to
+// the data recovery interface of the ground segment: one entry per listing
+// file with missing blocks giving its UPI, its channel, the acquisition
+// window of its dat files and the ranges of sequence counters to send again.
+type retransmission struct {
+	mu   sync.Mutex
+	file string
+
+	Program  string           `json:"program"`
+	Version  string           `json:"version"`
+	Created  time.Time        `json:"created"`
+	Requests []requestListing `json:"requests"`
+}
+
+type requestListing struct {
+	UPI     string     `json:"upi"`
+	Channel string     `json:"channel,omitempty"`
+	From    *time.Time `json:"from,omitempty"`
+	To      *time.Time `json:"to,omitempty"`
+	Listing string     `json:"listing"`
+	Missing int        `json:"missing"`
+	Ranges  []gap      `json:"ranges"`
+}
+
+func newRetransmission(file string) *retransmission {
+	return &retransmission{
+		file:     file,
+		Program:  Program,
+		Version:  Version,
+		Requests: []requestListing{},
+	}
+}
+
+// Add records the blocks missing in the listing file m once closed,
+// including the ones missing at its end.
+func (r *retransmission) Add(m *mvis, upis []string) {
+	if r == nil {
+		return
+	}
+	ranges := append([]gap(nil), m.Gaps...)
+	if tail := m.missingTail(); tail > 0 {
+		ranges = append(ranges, gap{
+			First: (m.last + 1) & counterMask,
+			Last:  (m.last + uint16(tail)) & counterMask,
+			Count: tail,
+		})
+	}
+	if len(ranges) == 0 {
+		return
+	}
+	q := requestListing{
+		UPI:     upiOf(m, upis),
+		Listing: m.Name,
+		Ranges:  ranges,
+	}
+	for _, g := range ranges {
+		q.Missing += g.Count
+	}
+	if len(m.sources) > 0 {
+		src := parseSource(m.sources[0])
+		if q.Channel = src.Channel; q.Channel == "" {
+			q.Channel, _, _ = strings.Cut(filepath.Base(src.Path), "_")
+		}
+	}
+	if a := acquisitionOf(m.sources); a != nil && !a.Start.IsZero() {
+		q.From, q.To = &a.Start, &a.End
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Requests = append(r.Requests, q)
+}
+
+// WriteFile writes the request as JSON. The file is written even without
+// missing blocks: an empty list of requests then tells that nothing has to
+// be sent again.
+func (r *retransmission) WriteFile() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Created = time.Now().UTC()
+	w, err := os.Create(r.file)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// validCounter reports whether s can be found at the beginning of a block.
+func validCounter(s uint16) bool {
+	return s < counterLimit || s == FileFlag || s == MilFlag
+}
+
+// inSync reports whether bs starts with two consecutive blocks that look
+// genuine: both have a valid counter and the second follows the first (or
+// one of them is a FileFlag or a MilFlag block).
+func inSync(bs []byte) bool {
+	s1 := binary.BigEndian.Uint16(bs)
+	s2 := binary.BigEndian.Uint16(bs[LineSize:])
+	if !validCounter(s1) || !validCounter(s2) {
+		return false
+	}
+	if s1 >= counterLimit || s2 >= counterLimit {
+		return true
+	}
+	return s2 == s1 || s2 == (s1+1)&counterMask
+}
+
+// readBlock reads the next block of the current dat file. When the block
+// read has an invalid counter (garbled region in the file) or a counter that
+// does not follow the previous one without being confirmed by the next block,
+// the following bytes are scanned until two consecutive blocks look genuine.
+func (f *fileReader) readBlock(bs []byte) (int, error) {
+	n := copy(bs, f.pending)
+	f.pending = f.pending[n:]
+	if n < len(bs) {
+		x, err := f.file.Read(bs[n:])
+		n += x
+		if err != nil {
+			return n, err
+		}
+	}
+	if n == LineSize {
+		f.block++
+	}
+	if len(bs) != LineSize || n < LineSize {
+		return n, nil
+	}
+	if s := binary.BigEndian.Uint16(bs); !validCounter(s) || !f.follows(s) && !f.confirmed(bs, s) {
+		x, err := f.resync(bs)
+		if err != nil {
+			return x, err
+		}
+		n = x
+	}
+	if s := binary.BigEndian.Uint16(bs); s < counterLimit {
+		f.seq, f.synced = s, true
+	}
+	return n, nil
+}
+
+// follows reports whether the counter s can be accepted without checking the
+// next block: flags and counters following (or repeating) the previous one.
+func (f *fileReader) follows(s uint16) bool {
+	if s >= counterLimit {
+		return true
+	}
+	return f.synced && (s == f.seq || s == (f.seq+1)&counterMask)
+}
+
+// confirmed reports whether the block bs with the counter s is followed by a
+// block in sequence with it. Without next block (end of the file), only a
+// jump of the counter that is not suspicious is accepted.
+func (f *fileReader) confirmed(bs []byte, s uint16) bool {
+	for len(f.pending) < LineSize {
+		chunk := make([]byte, LineSize-len(f.pending))
+		n, err := f.file.Read(chunk)
+		f.pending = append(f.pending, chunk[:n]...)
+		if err != nil || n == 0 {
+			// errors are reported by the next read
+			return !f.synced || (s-f.seq)&counterMask <= validateWindow
+		}
+	}
+	return inSync(append(append([]byte(nil), bs...), f.pending[:LineSize]...))
+}
+
+func (f *fileReader) resync(bs []byte) (int, error) {
+	buf := append([]byte(nil), bs...)
+	buf = append(buf, f.pending...)
+	f.pending = nil
+
+	var skipped int
+	for {
+		for len(buf) < 2*LineSize {
+			chunk := make([]byte, LineSize)
+			n, err := f.file.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if err == io.EOF || (err == nil && n == 0) {
+				slog.Warn("garbled data skipped until end of file", "file", f.Filename(), "bytes", skipped+len(buf))
+				quarantine(f.Filename(), "garbled data", fmt.Errorf("%d bytes skipped until end of file", skipped+len(buf)))
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		if inSync(buf) {
+			break
+		}
+		buf, skipped = buf[1:], skipped+1
+	}
+	slog.Warn("garbled data skipped", "file", f.Filename(), "bytes", skipped)
+	quarantine(f.Filename(), "garbled data", fmt.Errorf("%d bytes skipped", skipped))
+	copy(bs, buf)
+	f.pending = append(f.pending, buf[LineSize:]...)
+	return LineSize, nil
+}
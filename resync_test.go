@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadBlockResync(t *testing.T) {
+	garbage := func(seq uint16, n int) []byte {
+		bs := make([]byte, n)
+		for i := range bs {
+			bs[i] = byte(i*7 + 3)
+		}
+		binary.BigEndian.PutUint16(bs, seq)
+		return bs
+	}
+	var data []byte
+	for i := 1; i <= 10; i++ {
+		if i == 6 {
+			// valid counter that does not follow the previous block
+			data = append(data, garbage(3000, LineSize)...)
+		}
+		data = append(data, testBlock(uint16(i))...)
+	}
+	// trailing garbage that can not be confirmed by a next block
+	data = append(data, garbage(2800, LineSize+32)...)
+
+	f := fileReader{
+		file: &sourceFile{
+			Reader: bytes.NewReader(data),
+			file:   &entryFile{name: "test.dat"},
+		},
+	}
+	var got []uint16
+	for {
+		bs := make([]byte, LineSize)
+		n, err := f.readBlock(bs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n == LineSize {
+			got = append(got, binary.BigEndian.Uint16(bs))
+		}
+	}
+	if len(got) != 10 {
+		t.Fatalf("blocks mismatch: want 10, got %d (%v)", len(got), got)
+	}
+	for i, s := range got {
+		if s != uint16(i+1) {
+			t.Errorf("block %d: counter mismatch: want %d, got %d", i, i+1, s)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var (
+	// retryCount is the number of times the opening of a dat file is
+	// retried after a failure (-retry).
+	retryCount int
+	// retryWait is the delay between two attempts (-retry-wait).
+	retryWait = time.Second
+	// continueOnError is set when errors only stop the processing of the
+	// listing file or the dat file concerned (-continue).
+	continueOnError bool
+)
+
+// openDirect is openRaw ignoring the files prefetched. Failures are retried
+// (see -retry) unless the file does not exist.
+func openDirect(p string) (rawFile, error) {
+	var (
+		f   rawFile
+		err error
+	)
+	for i := 0; ; i++ {
+		if f, err = openOnce(p); err == nil || i >= retryCount || errors.Is(err, os.ErrNotExist) {
+			return f, err
+		}
+		slog.Warn("open failed, retrying", "file", p, "attempt", i+1, "wait", retryWait, "err", err)
+		time.Sleep(retryWait)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// rollingSuffix ends the name of the dat file hadock is still writing: it is
+// renamed without it once finalized.
+const rollingSuffix = ".rt"
+
+// includePartial is set when the dat file still written by hadock for each
+// channel and UPI is read with the finalized ones (-include-partial).
+var includePartial bool
+
+func isRolling(p string) bool {
+	return strings.HasSuffix(p, rollingSuffix)
+}
+
+// selectRolling removes the rolling files from ps (sorted by sortPaths). With
+// -include-partial, the last one of each channel and UPI is kept unless the
+// finalized version of the file is also there (the others are left behind
+// by an interrupted acquisition).
+func selectRolling(ps []string) []string {
+	var (
+		xs     []string
+		final  = make(map[string]bool)
+		latest = make(map[string]string)
+	)
+	for _, p := range ps {
+		if !isRolling(p) {
+			final[p] = true
+			xs = append(xs, p)
+			continue
+		}
+		if includePartial {
+			latest[streamOf(p)] = p
+		}
+	}
+	if len(latest) == 0 {
+		return xs
+	}
+	for _, p := range ps {
+		if !isRolling(p) || latest[streamOf(p)] != p {
+			continue
+		}
+		if final[strings.TrimSuffix(p, rollingSuffix)] {
+			continue
+		}
+		slog.Debug("partial dat file included", "file", p)
+		xs = append(xs, p)
+	}
+	sortPaths(xs)
+	return xs
+}
+
+// streamOf gives the channel and the UPI of the dat file p: its name without
+// the acquisition time (year, day, hour and minute) and the version.
+func streamOf(p string) string {
+	base, _, _ := strings.Cut(filepath.Base(p), ".")
+	parts := strings.Split(base, "_")
+	if len(parts) > 5 {
+		parts = parts[:len(parts)-5]
+	}
+	return strings.Join(parts, "_")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// rotateFileFlag makes listing files rotate on each FileFlag block.
+const rotateFileFlag = "fileflag"
+
+// rotation closes the listing files being received as a continuous stream
+// (-listen, -stdin) at regular interval or on each FileFlag block and goes
+// on in a new part named after the time it was created (-rotate).
+type rotation struct {
+	Every    time.Duration
+	FileFlag bool
+
+	// time given to the last file created
+	last time.Time
+}
+
+func parseRotate(str string) (*rotation, error) {
+	if str == rotateFileFlag {
+		return &rotation{FileFlag: true}, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid rotation: %s (duration or %s)", str, rotateFileFlag)
+	}
+	return &rotation{Every: d}, nil
+}
+
+// Due reports whether the part of the listing file m has been written long
+// enough.
+func (r *rotation) Due(m *mvis) bool {
+	return r != nil && r.Every > 0 && time.Since(m.created) >= r.Every
+}
+
+// OnFileFlag reports whether listing files are rotated on FileFlag blocks.
+func (r *rotation) OnFileFlag() bool {
+	return r != nil && r.FileFlag
+}
+
+// Name gives the name of the part of the listing file n created at when.
+// Parts created in the same millisecond are given the following ones so
+// that they never overwrite each other.
+func (r *rotation) Name(n string, when time.Time) string {
+	when = when.Truncate(time.Millisecond)
+	if !when.After(r.last) {
+		when = r.last.Add(time.Millisecond)
+	}
+	r.last = when
+	return n + "." + when.UTC().Format("20060102T150405.000Z")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// rule gives the options used for the listing files of the dat files of a
+// UPI and/or whose name matches a pattern (-rules).
+type rule struct {
+	UPI  string
+	File string
+
+	Text     *bool
+	Dir      string
+	Template *template.Template
+	Compress string
+	Manifest string
+}
+
+// ruleSet is the list of rules read from the file given with -rules. The
+// first rule matching a listing file gives its options. Manifests are shared
+// by all the listing files using the same digest.
+type ruleSet struct {
+	rules     []rule
+	manifests map[string]*manifest
+}
+
+// readRules reads the rules from file. Rules are given as a YAML list of
+// mappings or as TOML [[rule]] tables, with the same limits as the
+// configuration files (one key and value per line).
+func readRules(file string) (*ruleSet, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sep := "="
+	switch filepath.Ext(file) {
+	case ".yml", ".yaml":
+		sep = ":"
+	}
+	var (
+		set = ruleSet{manifests: make(map[string]*manifest)}
+		s   = bufio.NewScanner(r)
+	)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		switch {
+		case sep == "=" && line == "[[rule]]":
+			set.rules = append(set.rules, rule{})
+			continue
+		case sep == ":" && strings.HasPrefix(line, "- "):
+			set.rules = append(set.rules, rule{})
+			line = strings.TrimSpace(line[2:])
+		}
+		if len(set.rules) == 0 {
+			return nil, fmt.Errorf("%s:%d: option given outside of a rule", file, i)
+		}
+		ix := strings.Index(line, sep)
+		if ix < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", file, i, line)
+		}
+		key := strings.TrimSpace(line[:ix])
+		value := unquote(strings.TrimSpace(line[ix+1:]))
+		if err := set.rules[len(set.rules)-1].set(key, value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, i, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for i, r := range set.rules {
+		if r.UPI == "" && r.File == "" {
+			return nil, fmt.Errorf("%s: rule %d: upi or file expected", file, i+1)
+		}
+		if r.Manifest != "" && set.manifests[r.Manifest] == nil {
+			m, err := newManifest(r.Manifest)
+			if err != nil {
+				return nil, err
+			}
+			set.manifests[r.Manifest] = m
+		}
+	}
+	return &set, nil
+}
+
+func (r *rule) set(key, value string) error {
+	switch key {
+	case "upi", "file":
+		if _, err := filepath.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", value, err)
+		}
+		if key == "upi" {
+			r.UPI = value
+		} else {
+			r.File = value
+		}
+	case "text":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for text: %s", value)
+		}
+		r.Text = &v
+	case "dir":
+		if filepath.IsAbs(value) || strings.HasPrefix(filepath.Clean(value), "..") {
+			return fmt.Errorf("invalid directory %s: relative path under DATADIR expected", value)
+		}
+		r.Dir = value
+	case "name-template":
+		t, err := template.New("name").Parse(value)
+		if err != nil {
+			return err
+		}
+		r.Template = t
+	case "compress":
+		if _, err := compressSuffix(value); err != nil {
+			return err
+		}
+		r.Compress = value
+	case "manifest":
+		r.Manifest = value
+	default:
+		return fmt.Errorf("unknown option %s", key)
+	}
+	return nil
+}
+
+func (r *rule) Match(src source, name string) bool {
+	if r.UPI != "" && !matchUPI(r.UPI, src.UPI) {
+		return false
+	}
+	return r.File == "" || selected(name, []string{r.File})
+}
+
+// Apply gives the options and the output directory of the listing file name
+// built from the dat files described by src.
+func (s *ruleSet) Apply(src source, name, datadir string, opts options) (options, string) {
+	if s == nil {
+		return opts, datadir
+	}
+	for _, r := range s.rules {
+		if !r.Match(src, name) {
+			continue
+		}
+		if r.Text != nil {
+			opts.text, opts.autoText = *r.Text, false
+		}
+		if r.Dir != "" {
+			datadir = filepath.Join(datadir, r.Dir)
+		}
+		if r.Template != nil {
+			opts.template = r.Template
+		}
+		if r.Compress != "" {
+			opts.compress = r.Compress
+		}
+		if r.Manifest != "" {
+			opts.manifest = s.manifests[r.Manifest]
+		}
+		break
+	}
+	return opts, datadir
+}
+
+// Share makes the rules use m (the manifest given with -manifest) for the
+// listing files using the same digest.
+func (s *ruleSet) Share(m *manifest) {
+	if s != nil && m != nil {
+		s.manifests[m.algo] = m
+	}
+}
+
+// WriteManifests writes in datadir the manifests of the rules except skip
+// (the manifest given with -manifest, written separately).
+func (s *ruleSet) WriteManifests(store storage, datadir string, skip *manifest) error {
+	if s == nil {
+		return nil
+	}
+	var algos []string
+	for a := range s.manifests {
+		algos = append(algos, a)
+	}
+	sort.Strings(algos)
+	for _, a := range algos {
+		m := s.manifests[a]
+		if m == skip {
+			continue
+		}
+		if err := m.WriteFile(store, datadir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of the parts sent when a listing file is uploaded
+// with a multipart upload. Files smaller than this are sent in one request.
+const s3PartSize = 16 << 20
+
+// s3Storage writes listing files as objects in a S3 bucket. Credentials and
+// region are taken from the usual AWS_* environment variables. An endpoint
+// other than AWS (eg: minio) can be given with AWS_ENDPOINT_URL.
+type s3Storage struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+
+	key    string
+	secret string
+	token  string
+}
+
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	s := s3Storage{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: os.Getenv("AWS_REGION"),
+		key:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("%s: bucket not set", u)
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.key == "" || s.secret == "" {
+		return nil, fmt.Errorf("%s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set", u)
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	s.endpoint = e
+	return &s, nil
+}
+
+func (s *s3Storage) Create(n string) (io.WriteCloser, error) {
+	w := s3Writer{
+		store: s,
+		key:   s.objectKey(n),
+	}
+	return &w, nil
+}
+
+func (s *s3Storage) Remove(n string) error {
+	rs, err := s.do(http.MethodDelete, s.objectKey(n), nil, nil, nil)
+	if err == nil {
+		rs.Body.Close()
+	}
+	return err
+}
+
+func (s *s3Storage) Exists(n string) bool {
+	rs, err := s.do(http.MethodHead, s.objectKey(n), nil, nil, nil)
+	if err != nil {
+		return false
+	}
+	rs.Body.Close()
+	return true
+}
+
+func (s *s3Storage) objectKey(n string) string {
+	return path.Join(s.prefix, filepath.ToSlash(n))
+}
+
+// do sends a signed request for the given object with the extra headers
+// given. An error is returned for any response with a status code other
+// than 2xx.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.RawPath = path.Join(u.Path, "/", s3Escape(s.bucket, false), s3Escape(key, true))
+	u.Path = path.Join(u.Path, "/", s.bucket, key)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if s.token != "" {
+		req.Header.Set("x-amz-security-token", s.token)
+	}
+	signV4(req, body, s.key, s.secret, s.region, time.Now())
+
+	rs, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rs.StatusCode/100 != 2 {
+		defer rs.Body.Close()
+		msg := struct {
+			Code    string
+			Message string
+		}{Code: rs.Status}
+		xml.NewDecoder(rs.Body).Decode(&msg)
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, msg.Code, msg.Message)
+	}
+	return rs, nil
+}
+
+// s3Writer uploads the object once closed if its size is lower than
+// s3PartSize. Otherwise, parts are uploaded as soon as they are full.
+type s3Writer struct {
+	store *s3Storage
+	key   string
+	buf   bytes.Buffer
+
+	upload  string
+	parts   []s3Part
+	aborted bool
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(bs []byte) (int, error) {
+	n, _ := w.buf.Write(bs)
+	for w.buf.Len() >= s3PartSize {
+		if err := w.sendPart(w.buf.Next(s3PartSize)); err != nil {
+			w.abort()
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.aborted {
+		return nil
+	}
+	if w.upload == "" {
+		rs, err := w.store.do(http.MethodPut, w.key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return rs.Body.Close()
+	}
+	if w.buf.Len() > 0 {
+		if err := w.sendPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	c := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts}
+	body, err := xml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	rs, err := w.store.do(http.MethodPost, w.key, url.Values{"uploadId": {w.upload}}, nil, body)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	return rs.Body.Close()
+}
+
+// Rename changes the key of the object. It fails once parts of the object
+// have been uploaded.
+func (w *s3Writer) Rename(n string) error {
+	if w.upload != "" {
+		return fmt.Errorf("%s: can not be renamed once partially uploaded", n)
+	}
+	w.key = w.store.objectKey(n)
+	return nil
+}
+
+func (w *s3Writer) sendPart(bs []byte) error {
+	if w.upload == "" {
+		rs, err := w.store.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer rs.Body.Close()
+		c := struct {
+			UploadId string
+		}{}
+		if err := xml.NewDecoder(rs.Body).Decode(&c); err != nil {
+			return err
+		}
+		w.upload = c.UploadId
+	}
+	p := s3Part{Number: len(w.parts) + 1}
+	q := url.Values{
+		"partNumber": {fmt.Sprint(p.Number)},
+		"uploadId":   {w.upload},
+	}
+	rs, err := w.store.do(http.MethodPut, w.key, q, nil, bs)
+	if err != nil {
+		return err
+	}
+	rs.Body.Close()
+	p.ETag = rs.Header.Get("ETag")
+	w.parts = append(w.parts, p)
+	return nil
+}
+
+// Abort discards the object: nothing is sent when the writer is closed.
+func (w *s3Writer) Abort() error {
+	w.abort()
+	w.aborted = true
+	return nil
+}
+
+func (w *s3Writer) abort() {
+	if w.upload == "" {
+		return
+	}
+	if rs, err := w.store.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.upload}}, nil, nil); err == nil {
+		rs.Body.Close()
+	}
+	w.upload = ""
+}
+
+// signV4 signs req following the AWS signature version 4 process. All the
+// headers of the request are signed.
+func signV4(req *http.Request, body []byte, key, secret, region string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+
+	req.Header.Set("x-amz-date", stamp)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canon strings.Builder
+	canon.WriteString(req.Method + "\n")
+	canon.WriteString(req.URL.EscapedPath() + "\n")
+	canon.WriteString(req.URL.RawQuery + "\n")
+	for _, k := range names {
+		canon.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canon.WriteString("\n" + signed + "\n" + payload)
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canon.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", key, scope, signed, sig)
+	req.Header.Set("Authorization", auth)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query encodes the query string in the canonical form expected by S3: keys
+// sorted and values always present even when empty.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape encodes every byte of s except the unreserved characters and,
+// when slash is set, the slashes.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~' || (slash && c == '/'):
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
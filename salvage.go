@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// salvageBad is set when the blocks of bad files are only used to fill the
+// gaps of the healthy files of the same acquisition (-salvage).
+var salvageBad bool
+
+// groupKey gives the part of the name shared by the versions of a dat file
+// (only the version is cut, never a part of the directories).
+func groupKey(p string) string {
+	if ix := strings.LastIndex(p, "_"); ix > strings.LastIndexByte(p, filepath.Separator) {
+		return p[:ix]
+	}
+	return p
+}
+
+// pairBadFiles gives for each bad file of bad the healthy file of the same
+// acquisition found in good. Bad files without healthy counterpart are
+// returned in the second value.
+func pairBadFiles(good, bad []string) (map[string][]string, []string) {
+	keys := make(map[string]string)
+	for _, g := range good {
+		keys[groupKey(g)] = g
+	}
+	pairs := make(map[string][]string)
+	var alone []string
+	for _, b := range bad {
+		if g, ok := keys[groupKey(b)]; ok {
+			pairs[g] = append(pairs[g], b)
+		} else {
+			alone = append(alone, b)
+		}
+	}
+	return pairs, alone
+}
+
+func readBlocks(p string) ([][]byte, *vmuHeader, error) {
+	r, err := openFile(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bs [][]byte
+	for len(data) >= LineSize {
+		bs, data = append(bs, data[:LineSize]), data[LineSize:]
+	}
+	return bs, r.header, nil
+}
+
+type blockKey struct {
+	name string
+	seq  uint16
+}
+
+// mergeBlocks inserts in the gaps between the blocks of good the blocks of
+// other having the missing counters. Blocks of other following the last
+// block of a listing file in good are appended as well. from gives for each
+// block of good the file it comes from and is updated with origin for the
+// blocks taken from other.
+func mergeBlocks(good [][]byte, from []int, other [][]byte, origin int) ([][]byte, []int) {
+	var (
+		name  string
+		extra = make(map[blockKey][]byte)
+	)
+	for _, b := range other {
+		switch s := binary.BigEndian.Uint16(b); {
+		case s == FileFlag:
+			name, _ = dec.File(b)
+		case s < counterLimit:
+			k := blockKey{name: name, seq: s}
+			if _, ok := extra[k]; !ok {
+				extra[k] = b
+			}
+		}
+	}
+
+	var (
+		out     [][]byte
+		where   []int
+		prev    uint16
+		started bool
+	)
+	name = ""
+	fill := func(until uint16, open bool) {
+		for c := (prev + 1) & counterMask; open || c != until; c = (c + 1) & counterMask {
+			x, ok := extra[blockKey{name: name, seq: c}]
+			if !ok {
+				if open {
+					return
+				}
+				continue
+			}
+			out, where = append(out, x), append(where, origin)
+			prev = c
+		}
+	}
+	for i, b := range good {
+		switch s := binary.BigEndian.Uint16(b); {
+		case s == FileFlag:
+			if started {
+				fill(0, true)
+			}
+			name, _ = dec.File(b)
+			started = false
+		case s < counterLimit:
+			if diff := (s - prev) & counterMask; started && diff > 1 && diff < counterLimit/2 {
+				fill(s, false)
+			}
+			prev, started = s, true
+		}
+		out, where = append(out, b), append(where, from[i])
+	}
+	if started {
+		fill(0, true)
+	}
+	return out, where
+}
+
+// openMerged gives the content of the dat file good with the gaps filled by
+// the blocks of the files in others, tried in order. The second value gives
+// for each block the index of the file it comes from in the list made of
+// good followed by others.
+func openMerged(good string, others []string) (*sourceFile, []int, error) {
+	blocks, header, err := readBlocks(good)
+	if err != nil {
+		return nil, nil, err
+	}
+	from := make([]int, len(blocks))
+	for i, o := range others {
+		bs, _, err := readBlocks(o)
+		if err != nil {
+			slog.Warn("file not merged", "file", o, "err", err)
+			continue
+		}
+		before := len(blocks)
+		blocks, from = mergeBlocks(blocks, from, bs, i+1)
+		if n := len(blocks) - before; n > 0 {
+			slog.Info("blocks merged", "file", o, "into", good, "count", n)
+		}
+	}
+	info, err := statRaw(good)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := &countReader{Reader: bytes.NewReader(bytes.Join(blocks, nil))}
+	s := sourceFile{
+		Reader: raw,
+		raw:    raw,
+		header: header,
+		file: &entryFile{
+			name:  good,
+			info:  info,
+			close: func() error { return nil },
+		},
+	}
+	return &s, from, nil
+}
+
+// origin gives the dat file of the last block read.
+func (f *fileReader) origin() string {
+	if f.block > 0 && f.block <= len(f.from) {
+		return f.merged[f.from[f.block-1]]
+	}
+	return f.file.Name()
+}
+
+// Salvaged reports whether the last block read has been taken from a bad
+// file to fill a gap of a healthy one.
+func (f *fileReader) Salvaged() bool {
+	if f.block == 0 || f.block > len(f.from) {
+		return false
+	}
+	i := f.from[f.block-1]
+	return i > 0 && isBad(f.merged[i])
+}
+
+// salvagedRanges gives the ranges of salvaged blocks in the metadata. It is
+// nil when no block has been salvaged so that no empty element is written.
+type salvagedRanges struct {
+	Ranges []gap `xml:"range"`
+}
+
+func (s *salvagedRanges) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Ranges)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// policies applied to the names of the listing files found in the FileFlag
+// blocks (-sanitize)
+const (
+	sanitizeReplace = "replace"
+	sanitizeReject  = "reject"
+	sanitizeNone    = "none"
+)
+
+func checkSanitize(policy string) error {
+	switch policy {
+	case sanitizeReplace, sanitizeReject, sanitizeNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid sanitize policy: %s", policy)
+	}
+}
+
+// reservedNames are the names of devices that can not be used as file names
+// on Windows (with or without extension).
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// sanitizeName gives a name that can be joined with the output directory
+// without escaping from it and that is valid on all systems. Absolute paths
+// are made relative, .. elements are dropped and characters that can not be
+// used in file names are replaced by _. With the reject policy, an error is
+// returned instead when name has to be changed.
+func sanitizeName(name, policy string) (string, error) {
+	if policy == sanitizeNone {
+		return name, nil
+	}
+	var parts []string
+	for _, p := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		p = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+				return '_'
+			}
+			return r
+		}, p)
+		if trimmed := strings.TrimRight(p, ". "); trimmed != p {
+			p = trimmed + strings.Repeat("_", len(p)-len(trimmed))
+		}
+		base, _, _ := strings.Cut(p, ".")
+		for _, r := range reservedNames {
+			if strings.EqualFold(base, r) {
+				p = "_" + p
+				break
+			}
+		}
+		parts = append(parts, p)
+	}
+	safe := strings.Join(parts, "/")
+	switch {
+	case safe == "":
+		return "", fmt.Errorf("invalid listing name %q", name)
+	case policy == sanitizeReject && safe != name:
+		return "", fmt.Errorf("unsafe listing name %q", name)
+	case safe != name:
+		return filepath.FromSlash(safe), nil
+	default:
+		return name, nil
+	}
+}
+
+// listingName gives the path of the listing file name (as found in the
+// FileFlag block) under dir once sanitized.
+func listingName(dir, name string, src source, seq int, opts options) (string, error) {
+	safe, err := sanitizeName(name, opts.sanitize)
+	if err != nil {
+		return "", err
+	}
+	if safe != name {
+		slog.Warn("listing name sanitized", "name", name, "file", safe)
+	}
+	file, err := outputName(dir, safe, src, seq, opts)
+	if err != nil {
+		return "", err
+	}
+	if opts.sanitize != sanitizeNone && !within(dir, file) {
+		return "", fmt.Errorf("listing file %s outside of %s", file, dir)
+	}
+	return file, nil
+}
+
+// within reports whether the file p is under the directory dir.
+func within(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
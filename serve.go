@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobRequest describes the dat files to convert: either an explicit list
+// of files of the archive (absolute or relative to it) or a list of UPI and
+// an optional time range used to select the files in the archive.
+type jobRequest struct {
+	Files []string  `json:"files,omitempty"`
+	UPI   []string  `json:"upi,omitempty"`
+	From  time.Time `json:"from,omitzero"`
+	To    time.Time `json:"to,omitzero"`
+
+	Keep     bool   `json:"keep,omitempty"`
+	Meta     bool   `json:"meta,omitempty"`
+	Text     bool   `json:"text,omitempty"`
+	Compress string `json:"compress,omitempty"`
+}
+
+type job struct {
+	ID      string     `json:"id"`
+	State   string     `json:"state"`
+	Error   string     `json:"error,omitempty"`
+	Created time.Time  `json:"created"`
+	Done    time.Time  `json:"done,omitzero"`
+	Files   []string   `json:"files,omitempty"`
+	Request jobRequest `json:"request"`
+}
+
+type server struct {
+	archive string
+	datadir string
+
+	mu    sync.Mutex
+	jobs  map[string]*job
+	last  int
+	queue chan *job
+}
+
+// runServe runs mvis2list as a daemon accepting conversion jobs over HTTP.
+//
+//	POST /jobs                  submit a job (JSON body, see jobRequest)
+//	GET  /jobs                  list the jobs
+//	GET  /jobs/{id}             status of a job
+//	GET  /jobs/{id}/files/{f}   download a listing or metadata file of a job
+func runServe(args []string) error {
+	set := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := set.String("addr", ":8080", "")
+	datadir := set.String("datadir", os.TempDir(), "")
+	archive := set.String("archive", "", "")
+	set.Usage = flag.Usage
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	s := server{
+		archive: *archive,
+		datadir: *datadir,
+		jobs:    make(map[string]*job),
+		queue:   make(chan *job, 64),
+	}
+	go s.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.submit)
+	mux.HandleFunc("GET /jobs", s.list)
+	mux.HandleFunc("GET /jobs/{id}", s.status)
+	mux.HandleFunc("GET /jobs/{id}/files/{file...}", s.download)
+	mux.Handle("GET /metrics", runMetrics)
+
+	slog.Info("listening", "addr", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+func (s *server) submit(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) == 0 && len(req.UPI) == 0 {
+		http.Error(w, "no files nor upi given", http.StatusBadRequest)
+		return
+	}
+	if s.archive == "" {
+		http.Error(w, "no archive configured", http.StatusBadRequest)
+		return
+	}
+	for i, p := range req.Files {
+		f, err := s.resolve(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Files[i] = f
+	}
+	if _, err := compressSuffix(req.Compress); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.last++
+	j := &job{
+		ID:      strconv.Itoa(s.last),
+		State:   jobQueued,
+		Created: time.Now().UTC(),
+		Request: req,
+	}
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- j:
+	default:
+		s.finish(j, nil, fmt.Errorf("too many jobs queued"))
+		http.Error(w, "too many jobs queued", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	s.reply(w, http.StatusAccepted, j)
+}
+
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	js := make([]job, 0, len(s.jobs))
+	for i := 1; i <= s.last; i++ {
+		if j, ok := s.jobs[strconv.Itoa(i)]; ok {
+			js = append(js, *j)
+		}
+	}
+	s.replyLocked(w, http.StatusOK, js)
+}
+
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[r.PathValue("id")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.replyLocked(w, http.StatusOK, j)
+}
+
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j, ok := s.jobs[r.PathValue("id")]
+	var done bool
+	if ok {
+		done = j.State == jobDone
+	}
+	s.mu.Unlock()
+	if !ok || !done {
+		http.NotFound(w, r)
+		return
+	}
+	file := filepath.Join(s.datadir, j.ID, filepath.FromSlash(filepath.Clean("/"+r.PathValue("file"))))
+	http.ServeFile(w, r, file)
+}
+
+// resolve gives the path of the dat file p once checked that it is found
+// under the archive (symbolic links included).
+func (s *server) resolve(p string) (string, error) {
+	root, err := filepath.Abs(s.archive)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	f, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, f)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: not in the archive", p)
+	}
+	return f, nil
+}
+
+func (s *server) reply(w http.ResponseWriter, code int, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replyLocked(w, code, v)
+}
+
+func (s *server) replyLocked(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *server) run() {
+	for j := range s.queue {
+		s.mu.Lock()
+		j.State = jobRunning
+		s.mu.Unlock()
+
+		slog.Info("job started", "job", j.ID)
+		files, err := s.execute(j.ID, j.Request)
+		s.finish(j, files, err)
+		if err != nil {
+			runMetrics.Error("")
+			slog.Error("job failed", "job", j.ID, "err", err)
+		} else {
+			slog.Info("job done", "job", j.ID, "files", len(files))
+		}
+	}
+}
+
+func (s *server) finish(j *job, files []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.Done, j.Files = time.Now().UTC(), files
+	if err != nil {
+		j.State, j.Error = jobFailed, err.Error()
+	} else {
+		j.State = jobDone
+	}
+}
+
+func (s *server) execute(id string, req jobRequest) ([]string, error) {
+	ps := req.Files
+	if len(req.UPI) > 0 {
+		var rules []upiRule
+		for _, u := range req.UPI {
+			rules = append(rules, upiRule{UPI: u})
+		}
+		var xs []string
+		for p := range listFiles(s.archive, rules) {
+			t := parseSource(p).Time
+			if (!req.From.IsZero() && t.Before(req.From)) || (!req.To.IsZero() && t.After(req.To)) {
+				continue
+			}
+			xs = append(xs, p)
+		}
+		sortPaths(xs)
+		ps = append(ps, selectRolling(xs)...)
+	}
+	r, err := NewReader(ps, req.Keep)
+	if err != nil {
+		return nil, err
+	}
+	opts := options{
+		meta:     req.Meta,
+		text:     req.Text,
+		compress: req.Compress,
+		conflict: conflictOverwrite,
+		prefer:   preferFirst,
+		total:    new(quality),
+		store:    localStorage{},
+	}
+	datadir := filepath.Join(s.datadir, id)
+	if err := dumpFiles(r, datadir, opts); err != nil {
+		return nil, err
+	}
+	var files []string
+	err = filepath.Walk(datadir, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(datadir, p)
+		if err == nil {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	return files, err
+}
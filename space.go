@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var errNoSpace = errors.New("not enough free space")
+
+// spaceInterval is the delay between two checks of the free space when the
+// run is paused until space is available.
+const spaceInterval = 30 * time.Second
+
+// spaceCheck makes sure that writing the listing files leaves at least Min
+// bytes free in the file system of the output directory (-min-free). When
+// Wait is set, the run is paused until enough space is available instead of
+// failing.
+type spaceCheck struct {
+	Dir  string
+	Min  int64
+	Wait bool
+}
+
+// Reserve checks that n more bytes can be written.
+func (s *spaceCheck) Reserve(n int64) error {
+	if s == nil {
+		return nil
+	}
+	for {
+		free, err := freeSpace(s.Dir)
+		if err != nil {
+			return err
+		}
+		if free-n >= s.Min {
+			return nil
+		}
+		if !s.Wait {
+			return fmt.Errorf("%w in %s: %d bytes needed, %d available (%d kept free)", errNoSpace, s.Dir, n, free, s.Min)
+		}
+		slog.Warn("waiting for free space", "dir", s.Dir, "needed", n, "available", free, "min", s.Min)
+		time.Sleep(spaceInterval)
+	}
+}
+
+// freeSpace gives the number of bytes available in the file system of dir
+// (or of its closest parent when it does not exist yet).
+func freeSpace(dir string) (int64, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
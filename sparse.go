@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// sparseFile is a listing file written with -sparse: it is preallocated to
+// the size announced in the FileFlag block and the missing blocks are left
+// as holes so that each block is found at the offset given by its sequence
+// counter.
+type sparseFile interface {
+	Truncate(int64) error
+	Seek(int64, int) (int64, error)
+}
+
+// checkSparse reports the options that can not be used with -sparse: the
+// position of the blocks is only known in uncompressed binary listing files
+// written as is in a local directory.
+func checkSparse(opts options) error {
+	switch {
+	case opts.text || opts.autoText:
+		return fmt.Errorf("-sparse can not be used with text listing files")
+	case opts.compress != "":
+		return fmt.Errorf("-sparse can not be used with -compress")
+	case opts.format == formatFramed:
+		return fmt.Errorf("-sparse can not be used with the %s format", formatFramed)
+	case opts.split > 0:
+		return fmt.Errorf("-sparse can not be used with -split")
+	}
+	if _, ok := opts.store.(localStorage); !ok {
+		return fmt.Errorf("-sparse can only be used with local directories")
+	}
+	return nil
+}
+
+// sparseOf gives the file w as a sparse file preallocated to size when
+// -sparse is set and the listing file is written as is (rules can still
+// make some of them text files).
+func sparseOf(w io.WriteCloser, size int, opts options) (sparseFile, error) {
+	if !opts.sparse || w == nil || opts.text || opts.autoText {
+		return nil, nil
+	}
+	f, ok := w.(sparseFile)
+	if !ok {
+		return nil, nil
+	}
+	if size > 0 {
+		if err := f.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// skip leaves a hole of n bytes in the sparse listing file. The hole is read
+// back as zeros: it is accounted as such in the digests of the file.
+func (m *mvis) skip(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	if m.buf != nil {
+		if err := m.buf.Flush(); err != nil {
+			return err
+		}
+	}
+	zeros := make([]byte, min(n, 32<<10))
+	for i := n; i > 0; i -= len(zeros) {
+		bs := zeros[:min(i, len(zeros))]
+		m.digest.Write(bs)
+		if m.sum != nil {
+			m.sum.Write(bs)
+		}
+	}
+	if _, err := m.sparse.Seek(int64(n), io.SeekCurrent); err != nil {
+		return err
+	}
+	m.plain.add(n)
+	m.raw.add(n)
+	m.Holes += n
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFile is the name of the file, written in datadir, that keeps track of
+// the dat files already converted by previous runs in incremental mode.
+const stateFile = ".mvis2list-state.json"
+
+// state records the dat files already converted. A dat file is considered as
+// converted only if its size and modification time did not change since.
+type state struct {
+	file  string
+	Files map[string]stateEntry `json:"files"`
+}
+
+type stateEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	When    time.Time `json:"converted"`
+}
+
+func loadState(file string) (*state, error) {
+	s := state{
+		file:  file,
+		Files: make(map[string]stateEntry),
+	}
+	r, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Filter gives the files of ps not yet converted.
+func (s *state) Filter(ps []string) []string {
+	var xs []string
+	for _, p := range ps {
+		e, ok := s.Files[p]
+		if !ok {
+			xs = append(xs, p)
+			continue
+		}
+		i, err := statRaw(p)
+		if err != nil || i.Size() != e.Size || !i.ModTime().Equal(e.ModTime) {
+			xs = append(xs, p)
+		}
+	}
+	return xs
+}
+
+func (s *state) Add(ps ...string) error {
+	now := time.Now().UTC()
+	for _, p := range ps {
+		i, err := statRaw(p)
+		if err != nil {
+			return err
+		}
+		s.Files[p] = stateEntry{
+			Size:    i.Size(),
+			ModTime: i.ModTime(),
+			When:    now,
+		}
+	}
+	return nil
+}
+
+// Save writes the state in a temporary file renamed once complete so that an
+// interrupted run never leaves a truncated state behind.
+func (s *state) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	w, err := os.Create(s.file + ".tmp")
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(s); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.Name(), s.file)
+}
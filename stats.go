@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+)
+
+// quality gives figures about the sequence counters of the blocks used to
+// reconstruct one or multiple listing files.
+type quality struct {
+	Files      int
+	Blocks     int
+	Missing    int
+	Duplicated int
+	Conflicts  int
+	Unordered  int
+	Longest    int
+}
+
+func qualityOf(m *mvis) quality {
+	q := quality{
+		Files:      1,
+		Blocks:     m.Blocks,
+		Missing:    m.Missing,
+		Duplicated: m.Duplicated,
+		Conflicts:  m.Conflicts,
+		Unordered:  m.Unordered,
+	}
+	for _, g := range m.Gaps {
+		if g.Count > q.Longest {
+			q.Longest = g.Count
+		}
+	}
+	return q
+}
+
+func (q *quality) Add(other quality) {
+	q.Files += other.Files
+	q.Blocks += other.Blocks
+	q.Missing += other.Missing
+	q.Duplicated += other.Duplicated
+	q.Conflicts += other.Conflicts
+	q.Unordered += other.Unordered
+	if other.Longest > q.Longest {
+		q.Longest = other.Longest
+	}
+}
+
+// Completeness gives the percentage of blocks available.
+func (q quality) Completeness() float64 {
+	if q.Blocks+q.Missing == 0 {
+		return 0
+	}
+	return float64(q.Blocks) * 100 / float64(q.Blocks+q.Missing)
+}
+
+func (q quality) String() string {
+	return fmt.Sprintf("%d blocks, %d missing, %d duplicated (%d conflicting), %d out-of-order, longest gap %d, %.2f%% complete",
+		q.Blocks, q.Missing, q.Duplicated, q.Conflicts, q.Unordered, q.Longest, q.Completeness())
+}
+
+// sourceStats gives figures about the blocks taken from one dat file.
+type sourceStats struct {
+	File   string
+	Blocks int
+	First  uint16
+	Last   uint16
+	// blocks missing between the last block of the previous dat file and the
+	// first one of this file
+	Before int
+	// the last block of the file was a fill block (MilFlag)
+	Fill bool
+}
+
+func (s sourceStats) String() string {
+	str := fmt.Sprintf("%s: %d blocks, sequence %d..%d, %d missing before", s.File, s.Blocks, s.First, s.Last, s.Before)
+	if s.Fill {
+		str += ", ended with fill block"
+	}
+	return str
+}
+
+// listingStats gives the byte counters of a listing file.
+type listingStats struct {
+	Blocks int
+	// bytes of the blocks written (sequence counters included) and of their
+	// payload
+	Raw     int
+	Payload int
+	// null bytes padding the payload removed from text listing files
+	Stripped int
+	// bytes written in the listing file before compression (records of the
+	// framed format, text conversion and holes of sparse files included) and
+	// bytes stored once compressed (the same without compression)
+	Written int
+	Stored  int
+}
+
+// Data gives the number of bytes of payload kept in the listing file.
+func (s listingStats) Data() int {
+	return s.Payload - s.Stripped
+}
+
+// Stats gives the byte counters of the listing file m. The bytes written are
+// only all counted once m is closed.
+func (m *mvis) Stats() listingStats {
+	s := m.counts
+	s.Blocks = m.Blocks
+	s.Written = m.plain.Count()
+	s.Stored = m.raw.Count()
+	return s
+}
+
+// count adds the block bs whose payload has been cut to data to the
+// counters of m.
+func (m *mvis) count(bs, payload, data []byte) {
+	m.counts.Raw += len(bs)
+	m.counts.Payload += len(payload)
+	m.counts.Stripped += len(payload) - len(data)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storage abstracts the place where listing files and their metadata are
+// written.
+type storage interface {
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+	Exists(name string) bool
+}
+
+// openStorage gives the storage to use for the given output location. When
+// the location is an URL, the second value returned is the base directory
+// to use for the names of the listing files.
+func openStorage(loc string) (storage, string, error) {
+	if !strings.Contains(loc, "://") {
+		return localStorage{}, loc, nil
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "s3":
+		s, err := newS3Storage(u)
+		return s, "", err
+	case "http", "https":
+		return &httpStorage{base: u}, "", nil
+	default:
+		return nil, "", fmt.Errorf("%s: unsupported output scheme", u.Scheme)
+	}
+}
+
+type localStorage struct{}
+
+// Create writes n in a temporary file (n.tmp) renamed once closed so that a
+// file partially written is never seen under its final name.
+func (localStorage) Create(n string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	f, err := os.Create(n + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, name: n}, nil
+}
+
+func (localStorage) Remove(n string) error {
+	return os.Remove(n)
+}
+
+func (localStorage) Exists(n string) bool {
+	_, err := os.Stat(n)
+	return err == nil
+}
+
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func (a *atomicFile) Close() error {
+	if err := a.File.Close(); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	if err := os.Rename(a.File.Name(), a.name); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	return nil
+}
+
+// Rename changes the name given to the file once closed.
+func (a *atomicFile) Rename(n string) error {
+	a.name = n
+	return nil
+}
+
+// Abort removes the temporary file leaving the previous version of the file,
+// if any, untouched.
+func (a *atomicFile) Abort() error {
+	a.File.Close()
+	return os.Remove(a.File.Name())
+}
+
+// renameTo changes the name of the file w being written in a storage. The
+// file is only created under its new name.
+func renameTo(w io.WriteCloser, n string) error {
+	if r, ok := w.(interface{ Rename(string) error }); ok {
+		return r.Rename(n)
+	}
+	return fmt.Errorf("%s: files can not be renamed in this storage", n)
+}
+
+// abort discards a file being written in a storage.
+func abort(w io.WriteCloser) error {
+	if a, ok := w.(interface{ Abort() error }); ok {
+		return a.Abort()
+	}
+	return w.Close()
+}
+
+// httpStorage uploads files with PUT requests to a WebDAV like server.
+type httpStorage struct {
+	base *url.URL
+}
+
+func (h *httpStorage) location(n string) string {
+	u := *h.base
+	u.Path = path.Join(u.Path, filepath.ToSlash(n))
+	return u.String()
+}
+
+func (h *httpStorage) do(method, n string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.location(n), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	rs, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	rs.Body.Close()
+	if rs.StatusCode >= http.StatusBadRequest {
+		return rs, fmt.Errorf("%s %s: %s", method, h.location(n), rs.Status)
+	}
+	return rs, nil
+}
+
+func (h *httpStorage) Create(n string) (io.WriteCloser, error) {
+	w := bufferWriter{
+		name: n,
+		flush: func(n string, r io.Reader, size int64) error {
+			_, err := h.do(http.MethodPut, n, r, size)
+			return err
+		},
+	}
+	return &w, nil
+}
+
+func (h *httpStorage) Remove(n string) error {
+	_, err := h.do(http.MethodDelete, n, nil, 0)
+	return err
+}
+
+func (h *httpStorage) Exists(n string) bool {
+	rs, err := h.do(http.MethodHead, n, nil, 0)
+	return err == nil && rs.StatusCode == http.StatusOK
+}
+
+// bufferWriter keeps in memory what is written and gives it to flush when
+// it is closed. Once the memory budget (-max-memory) is exhausted, the data
+// is moved to a temporary file (spill) written until it is closed.
+type bufferWriter struct {
+	buf     bytes.Buffer
+	spill   *os.File
+	size    int64
+	name    string
+	flush   func(string, io.Reader, int64) error
+	aborted bool
+}
+
+func (b *bufferWriter) Write(bs []byte) (int, error) {
+	if b.spill == nil && !memory.Grow(int64(len(bs))) {
+		f, err := os.CreateTemp("", "mvis2list-*")
+		if err != nil {
+			return 0, err
+		}
+		slog.Debug("listing spilled to disk", "file", b.name, "spill", f.Name(), "size", b.size)
+		b.spill = f
+		if _, err := f.Write(b.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		memory.Release(int64(b.buf.Len()))
+		b.buf = bytes.Buffer{}
+	}
+	var (
+		n   int
+		err error
+	)
+	if b.spill != nil {
+		n, err = b.spill.Write(bs)
+	} else {
+		n, err = b.buf.Write(bs)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *bufferWriter) Close() error {
+	defer b.release()
+	if b.aborted {
+		return nil
+	}
+	if b.spill == nil {
+		return b.flush(b.name, bytes.NewReader(b.buf.Bytes()), b.size)
+	}
+	return b.flush(b.name, io.NewSectionReader(b.spill, 0, b.size), b.size)
+}
+
+// release frees the memory or removes the temporary file holding the data.
+func (b *bufferWriter) release() {
+	if b.spill != nil {
+		b.spill.Close()
+		os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+	memory.Release(int64(b.buf.Len()))
+	b.buf = bytes.Buffer{}
+}
+
+func (b *bufferWriter) Rename(n string) error {
+	b.name = n
+	return nil
+}
+
+func (b *bufferWriter) Abort() error {
+	b.aborted = true
+	b.release()
+	return nil
+}
+
+// tarStorage writes all the files in a single tar archive. An index giving
+// the offset and the size of each file in the archive is written next to it
+// (with the .idx extension) once the archive is closed.
+type tarStorage struct {
+	file  *os.File
+	out   *countWriter
+	tw    *tar.Writer
+	index []tarEntry
+}
+
+type tarEntry struct {
+	Name   string
+	Offset int
+	Size   int
+}
+
+func newTarStorage(p string) (*tarStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	out := &countWriter{Writer: f}
+	return &tarStorage{file: f, out: out, tw: tar.NewWriter(out)}, nil
+}
+
+func (t *tarStorage) Create(n string) (io.WriteCloser, error) {
+	w := bufferWriter{
+		name:  n,
+		flush: t.add,
+	}
+	return &w, nil
+}
+
+func (t *tarStorage) add(n string, r io.Reader, size int64) error {
+	h := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(n),
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+	}
+	if err := t.tw.WriteHeader(&h); err != nil {
+		return err
+	}
+	// the header is written as soon as WriteHeader returns: the content
+	// of the file starts at the current position.
+	e := tarEntry{Name: h.Name, Offset: t.out.Count(), Size: int(size)}
+	if _, err := io.Copy(t.tw, r); err != nil {
+		return err
+	}
+	t.Remove(n)
+	t.index = append(t.index, e)
+	return nil
+}
+
+// Remove only removes n from the index since the archive can not be
+// rewritten.
+func (t *tarStorage) Remove(n string) error {
+	n = filepath.ToSlash(n)
+	for i, e := range t.index {
+		if e.Name == n {
+			t.index = append(t.index[:i], t.index[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (t *tarStorage) Exists(n string) bool {
+	n = filepath.ToSlash(n)
+	for _, e := range t.index {
+		if e.Name == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tarStorage) Close() error {
+	if err := t.tw.Close(); err != nil {
+		t.file.Close()
+		return err
+	}
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	w, err := os.Create(t.file.Name() + ".idx")
+	if err != nil {
+		return err
+	}
+	for _, e := range t.index {
+		if _, err := fmt.Fprintf(w, "%d\t%d\t%s\n", e.Offset, e.Size, e.Name); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// framing of the listing files written to stdout (-stdout-format)
+const (
+	stdoutRaw    = "raw"
+	stdoutHeader = "header"
+	stdoutTar    = "tar"
+)
+
+// stdoutStorage writes the files one after the other to stdout (-datadir -).
+// Files are kept in memory until closed so that they are never interleaved.
+// With the raw format, they are simply concatenated. With the header format,
+// each file is preceded by a line giving its name and its size
+// (==> NAME SIZE). With the tar format, they are written as a tar stream.
+type stdoutStorage struct {
+	w      io.Writer
+	format string
+	tw     *tar.Writer
+}
+
+func newStdoutStorage(w io.Writer, format string) (*stdoutStorage, error) {
+	s := stdoutStorage{w: w, format: format}
+	switch format {
+	case stdoutRaw, stdoutHeader:
+	case stdoutTar:
+		s.tw = tar.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("invalid stdout format: %s", format)
+	}
+	return &s, nil
+}
+
+func (s *stdoutStorage) Create(n string) (io.WriteCloser, error) {
+	w := bufferWriter{
+		name:  n,
+		flush: s.add,
+	}
+	return &w, nil
+}
+
+func (s *stdoutStorage) add(n string, r io.Reader, size int64) error {
+	switch s.format {
+	case stdoutHeader:
+		if _, err := fmt.Fprintf(s.w, "==> %s %d\n", filepath.ToSlash(n), size); err != nil {
+			return err
+		}
+	case stdoutTar:
+		h := tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(n),
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Now(),
+		}
+		if err := s.tw.WriteHeader(&h); err != nil {
+			return err
+		}
+		_, err := io.Copy(s.tw, r)
+		return err
+	}
+	_, err := io.Copy(s.w, r)
+	return err
+}
+
+// Remove does nothing: files already written can not be taken back.
+func (s *stdoutStorage) Remove(n string) error {
+	return nil
+}
+
+func (s *stdoutStorage) Exists(n string) bool {
+	return false
+}
+
+func (s *stdoutStorage) Close() error {
+	if s.tw != nil {
+		return s.tw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// streamReader reads the blocks of dat files concatenated in a single stream.
+// The headers of each dat file found between blocks are skipped as well as
+// the fill blocks (unless -keep-fill is set).
+type streamReader struct {
+	rs     *bufio.Reader
+	offset int
+	filled int
+}
+
+func NewStream(r io.Reader) *streamReader {
+	return &streamReader{rs: bufio.NewReader(r)}
+}
+
+func (s *streamReader) Read(bs []byte) (int, error) {
+	if s.offset == 0 {
+		if err := s.skip(); err != nil {
+			return 0, err
+		}
+	}
+	if n := LineSize - s.offset; len(bs) > n {
+		bs = bs[:n]
+	}
+	n, err := s.rs.Read(bs)
+	s.offset = (s.offset + n) % LineSize
+	return n, err
+}
+
+func (s *streamReader) skip() error {
+	for {
+		peek, err := s.rs.Peek(len(FCC))
+		if len(peek) < 2 {
+			return err
+		}
+		switch {
+		case isFCC(peek):
+			_, err = s.rs.Discard(len(FCC) + headerSize(peek))
+		case binary.BigEndian.Uint16(peek) == MilFlag:
+			s.filled++
+			if keepFill {
+				return nil
+			}
+			_, err = s.rs.Discard(LineSize)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Fills gives the number of fill blocks read so far.
+func (s *streamReader) Fills() int {
+	return s.filled
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	runOK          = "ok"
+	runFailed      = "failed"
+	runInterrupted = "interrupted"
+)
+
+// summary describes the outcome of a run for the tools driving mvis2list
+// (-summary). Its methods can be called on a nil summary.
+type summary struct {
+	mu sync.Mutex
+
+	Program  string        `json:"program"`
+	Version  string        `json:"version"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration float64       `json:"duration"`
+	Status   string        `json:"status"`
+	Exit     int           `json:"exit_code"`
+	Files    []summaryFile `json:"files"`
+	Blocks   int           `json:"blocks"`
+	Missing  int           `json:"missing"`
+	Gaps     int           `json:"gaps"`
+	Bytes    int           `json:"bytes"`
+	BadFiles int           `json:"bad_files"`
+	Errors   []string      `json:"errors"`
+}
+
+type summaryFile struct {
+	Name    string `json:"name"`
+	Blocks  int    `json:"blocks"`
+	Missing int    `json:"missing"`
+	Bytes   int    `json:"bytes"`
+	Size    string `json:"size_check"`
+	Gaps    []gap  `json:"gaps"`
+}
+
+func newSummary() *summary {
+	return &summary{
+		Program: Program,
+		Version: Version,
+		Start:   time.Now(),
+		Files:   []summaryFile{},
+		Errors:  []string{},
+	}
+}
+
+// Add records the listing file m once complete.
+func (s *summary) Add(m *mvis) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Files = append(s.Files, summaryFile{
+		Name:    m.Name,
+		Blocks:  m.Blocks,
+		Missing: m.Missing,
+		Bytes:   m.Stats().Written,
+		Size:    m.CheckSize().Status,
+		Gaps:    m.Gaps,
+	})
+	s.Blocks += m.Blocks
+	s.Missing += m.Missing
+	s.Gaps += len(m.Gaps)
+	s.Bytes += m.Stats().Written
+}
+
+func (s *summary) Error(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors = append(s.Errors, err.Error())
+}
+
+// WriteFile completes the summary with the status of the run and writes it
+// as JSON in file (stdout for "-"). Nothing is written without file (the
+// summary is then only used for the notifications).
+func (s *summary) WriteFile(file, status string, code int) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.End = time.Now()
+	s.Duration = s.End.Sub(s.Start).Seconds()
+	s.Status, s.Exit = status, code
+	if file == "" {
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(s)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	eolLF   = "lf"
+	eolCRLF = "crlf"
+	eolNone = "none"
+
+	encodingUTF8   = "utf8"
+	encodingLatin1 = "latin1"
+)
+
+// textWriter normalizes the line terminators and the encoding of the
+// payload of text listing files. It also counts the non printable characters
+// found in the payload.
+//
+// Bytes that do not form a valid UTF-8 sequence are considered to be Latin-1
+// characters.
+type textWriter struct {
+	w        io.Writer
+	eol      string
+	encoding string
+
+	rest        []byte
+	Unprintable int
+}
+
+func checkText(eol, encoding string) error {
+	switch eol {
+	case "", eolNone, eolLF, eolCRLF:
+	default:
+		return fmt.Errorf("invalid line terminator: %s", eol)
+	}
+	switch encoding {
+	case "", encodingUTF8, encodingLatin1:
+	default:
+		return fmt.Errorf("invalid encoding: %s", encoding)
+	}
+	return nil
+}
+
+func (t *textWriter) Write(bs []byte) (int, error) {
+	buf := append(t.rest, bs...)
+	t.rest = nil
+	if _, err := t.w.Write(t.convert(buf, false)); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+// Flush writes the bytes kept from the previous write because they could
+// be the beginning of a line terminator or of a multi-byte character.
+func (t *textWriter) Flush() error {
+	if len(t.rest) == 0 {
+		return nil
+	}
+	buf := t.rest
+	t.rest = nil
+	_, err := t.w.Write(t.convert(buf, true))
+	return err
+}
+
+func (t *textWriter) convert(buf []byte, final bool) []byte {
+	out := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		c := buf[i]
+		if c == '\r' && i+1 == len(buf) && !final {
+			t.rest = append(t.rest, buf[i:]...)
+			break
+		}
+		if c == '\n' || (c == '\r' && i+1 < len(buf) && buf[i+1] == '\n') {
+			n := 1
+			if c == '\r' {
+				n++
+			}
+			switch t.eol {
+			case eolLF:
+				out = append(out, '\n')
+			case eolCRLF:
+				out = append(out, '\r', '\n')
+			default:
+				out = append(out, buf[i:i+n]...)
+			}
+			i += n
+			continue
+		}
+		r, size := rune(c), 1
+		if c >= utf8.RuneSelf {
+			if !final && !utf8.FullRune(buf[i:]) {
+				t.rest = append(t.rest, buf[i:]...)
+				break
+			}
+			if x, n := utf8.DecodeRune(buf[i:]); x != utf8.RuneError || n > 1 {
+				r, size = x, n
+			}
+		}
+		if !printable(r) {
+			t.Unprintable++
+		}
+		switch t.encoding {
+		case encodingUTF8:
+			out = utf8.AppendRune(out, r)
+		case encodingLatin1:
+			if r > 0xFF {
+				r = '?'
+			}
+			out = append(out, byte(r))
+		default:
+			out = append(out, buf[i:i+size]...)
+		}
+		i += size
+	}
+	return out
+}
+
+func printable(r rune) bool {
+	switch {
+	case r == '\t' || r == '\r' || r == '\n':
+		return true
+	case r < 0x20 || r == 0x7F:
+		return false
+	case r >= 0x80 && r < 0xA0:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+)
+
+// previousSum gives the md5 recorded in the metadata of the listing file n
+// when it is about to be overwritten with -verify-before-overwrite, or an
+// empty string when the listing file or its metadata are not available.
+func previousSum(n string, opts options) string {
+	if !opts.verifyOverwrite || !opts.store.Exists(n) {
+		return ""
+	}
+	sum, err := readSum(n + ".xml")
+	if err != nil {
+		return ""
+	}
+	return sum
+}
+
+// createDeferred keeps the listing file n in memory (or in a temporary file
+// when the memory budget is exhausted) and only creates it in the storage
+// once closed. Aborting it leaves the previous version of the file, and its
+// modification time, untouched.
+func createDeferred(store storage, n string) io.WriteCloser {
+	return &bufferWriter{
+		name: n,
+		flush: func(n string, r io.Reader, _ int64) error {
+			w, err := store.Create(n)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, r); err != nil {
+				abort(w)
+				return err
+			}
+			return w.Close()
+		},
+	}
+}
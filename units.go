@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a number of bytes optionally followed by a K, M or G
+// suffix (powers of 1024).
+func parseSize(str string) (int64, error) {
+	var (
+		v          = strings.ToUpper(strings.TrimSpace(str))
+		unit int64 = 1
+	)
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	switch {
+	case strings.HasSuffix(v, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+	return n * unit, nil
+}
+
+// rawBytes is set when sizes are printed in bytes instead of human units
+// (-bytes).
+var rawBytes bool
+
+var sizeUnits = []string{"KiB", "MiB", "GiB", "TiB"}
+
+// formatSize gives n bytes in the largest unit (powers of 1024) in which it
+// is at least 1, rounded to one decimal, or in bytes below 1KiB and with
+// -bytes. The output never depends on the locale.
+func formatSize(n int64) string {
+	if rawBytes || n < 1<<10 && n > -1<<10 {
+		return strconv.FormatInt(n, 10) + " bytes"
+	}
+	v, unit := float64(n)/(1<<10), sizeUnits[0]
+	for _, u := range sizeUnits[1:] {
+		if v < 1<<10 && v > -1<<10 {
+			break
+		}
+		v, unit = v/(1<<10), u
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + " " + unit
+}
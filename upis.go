@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const upiDate = "2006-01-02"
+
+// upiRule is an entry of the list of UPI used in batch mode: a UPI, or a
+// pattern with wildcards (GRIP*), optionally restricted to a range of dates
+// (UPI 2018-11-01..2018-11-15). Both ends of the range are inclusive and can
+// be omitted.
+type upiRule struct {
+	UPI  string
+	From time.Time
+	To   time.Time
+}
+
+func parseUPIRule(line string) (upiRule, error) {
+	var u upiRule
+	fs := strings.Fields(line)
+	switch len(fs) {
+	case 1, 2:
+	default:
+		return u, fmt.Errorf("invalid upi: %s", line)
+	}
+	u.UPI = fs[0]
+	if _, err := filepath.Match(u.UPI, ""); err != nil {
+		return u, fmt.Errorf("invalid upi pattern %s: %s", u.UPI, err)
+	}
+	if len(fs) == 1 {
+		return u, nil
+	}
+	from, to, ok := strings.Cut(fs[1], "..")
+	if !ok {
+		return u, fmt.Errorf("invalid date range: %s", fs[1])
+	}
+	var err error
+	if from != "" {
+		if u.From, err = time.Parse(upiDate, from); err != nil {
+			return u, fmt.Errorf("invalid date range: %s", fs[1])
+		}
+	}
+	if to != "" {
+		if u.To, err = time.Parse(upiDate, to); err != nil {
+			return u, fmt.Errorf("invalid date range: %s", fs[1])
+		}
+		u.To = u.To.AddDate(0, 0, 1)
+	}
+	return u, nil
+}
+
+// Match reports whether the dat file p belongs to the UPI of the rule and
+// has been acquired in its range of dates.
+func (u upiRule) Match(p string) bool {
+	s := parseSource(p)
+	if !matchUPI(u.UPI, s.UPI) {
+		return false
+	}
+	if !u.From.IsZero() && s.Time.Before(u.From) {
+		return false
+	}
+	if !u.To.IsZero() && !s.Time.Before(u.To) {
+		return false
+	}
+	return true
+}
+
+// matchUPI reports whether the UPI found in the name of a dat file starts
+// with the pattern.
+func matchUPI(pattern, upi string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.HasPrefix(upi, pattern)
+	}
+	ok, _ := filepath.Match(pattern+"*", upi)
+	return ok
+}
+
+// upiNames gives the UPI (or patterns) of the rules.
+func upiNames(rules []upiRule) []string {
+	var set []string
+	for _, u := range rules {
+		set = append(set, u.UPI)
+	}
+	return set
+}
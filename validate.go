@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// validation checks the blocks read for signs of corruption that went
+// through the decoding (-validate). It is nil when blocks are not checked.
+var validation *validator
+
+const (
+	// validateWindow is the largest jump of the sequence counter between two
+	// blocks of a listing file that is not suspicious.
+	validateWindow = 512
+	// textEntropy is the entropy (bits per byte) above which the payload of
+	// a block of a text listing file is suspicious. Lines of text stay well
+	// below while random bytes in 62 bytes are close to 6 bits.
+	textEntropy = 5.2
+)
+
+// reasons a block is suspicious
+const (
+	suspectZero    = "all zeros"
+	suspectCounter = "counter jump"
+	suspectBitFlip = "counter jump (single bit)"
+	suspectBinary  = "binary data in text"
+	suspectEntropy = "high entropy for text"
+)
+
+// validator checks each block against the previous block of its listing
+// file and, for text listing files, against what lines of text look like.
+type validator struct {
+	// all listing files are text ones (-text) or only those of these UPI
+	// (-text-upi)
+	text     bool
+	textUPIs []string
+
+	last  map[string]lastBlock
+	Count int
+}
+
+// lastBlock is the sequence counter of the last block of a listing file and,
+// when it jumped, the counter of the block before it.
+type lastBlock struct {
+	seq    uint16
+	before uint16
+	jumped bool
+}
+
+func newValidator(text bool, textUPIs []string) *validator {
+	return &validator{
+		text:     text,
+		textUPIs: textUPIs,
+		last:     make(map[string]lastBlock),
+	}
+}
+
+// IsText reports whether the listing files of upi are known to be text ones.
+func (v *validator) IsText(upi string) bool {
+	return v.text || isTextUPI(upi, v.textUPIs)
+}
+
+// Check gives the reasons why the block b of the listing file name is
+// suspicious (none when it looks sane).
+func (v *validator) Check(name string, b Block, text bool) []string {
+	if v == nil || b.IsFill() || b.IsFileHeader() {
+		return nil
+	}
+	var reasons []string
+	payload := b.Payload()
+	if len(payload) > 0 && bytes.Count(payload, []byte{0}) == len(payload) {
+		reasons = append(reasons, suspectZero)
+	}
+	s := b.Sequence() & counterMask
+	if prev, ok := v.last[name]; ok {
+		next := lastBlock{seq: s}
+		want := (prev.seq + 1) & counterMask
+		switch diff := (s - prev.seq) & counterMask; {
+		case diff > 0 && diff <= validateWindow:
+		case prev.jumped && (s-prev.before)&counterMask > 0 && (s-prev.before)&counterMask <= validateWindow:
+			// back after a single block out of the sequence: this one is
+			// fine, the previous one was already reported.
+		default:
+			next.before, next.jumped = prev.seq, true
+			if bits.OnesCount16(s^want) == 1 {
+				reasons = append(reasons, suspectBitFlip)
+			} else {
+				reasons = append(reasons, suspectCounter)
+			}
+		}
+		v.last[name] = next
+	} else {
+		v.last[name] = lastBlock{seq: s}
+	}
+	if text {
+		bs := bytes.TrimRight(payload, "\x00")
+		switch {
+		case len(bs) == 0:
+		case !looksText([]probed{{block: b.Bytes()}}):
+			reasons = append(reasons, suspectBinary)
+		case entropy(bs) > textEntropy:
+			reasons = append(reasons, suspectEntropy)
+		}
+	}
+	if len(reasons) > 0 {
+		v.Count++
+	}
+	return reasons
+}
+
+// Warn checks the block b written in the listing file m and logs it when it
+// is suspicious.
+func (v *validator) Warn(m *mvis, b Block, file string) {
+	if rs := v.Check(m.Name, b, m.text); len(rs) > 0 {
+		slog.Warn("suspicious block", "file", m.Name, "sequence", b.Sequence(), "source", file, "reasons", strings.Join(rs, ", "))
+	}
+}
+
+func (v *validator) String() string {
+	return fmt.Sprintf("%d suspicious blocks", v.Count)
+}
+
+// entropy gives the Shannon entropy of bs in bits per byte.
+func entropy(bs []byte) float64 {
+	var counts [256]int
+	for _, b := range bs {
+		counts[b]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(len(bs))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
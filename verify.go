@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// verifier compares the listing files reconstructed in memory with the
+// listing files (and their metadata) already available on disk.
+type verifier struct {
+	Files  int
+	Failed int
+}
+
+func (v *verifier) Verify(m *mvis) {
+	v.Files++
+
+	var (
+		errs []string
+		sum  = fmt.Sprintf("%x", m.digest.Sum(nil))
+	)
+	if other, size, err := digestFile(m.Name); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		if other != sum {
+			errs = append(errs, fmt.Sprintf("md5 mismatch (listing: %s, sources: %s)", other, sum))
+		}
+		if n := m.Stats().Written; size != int64(n) {
+			errs = append(errs, fmt.Sprintf("size mismatch (listing: %d, sources: %d)", size, n))
+		}
+	}
+	switch other, err := readSum(m.Name + ".xml"); {
+	case err != nil && !os.IsNotExist(err):
+		errs = append(errs, err.Error())
+	case err == nil && other != sum:
+		errs = append(errs, fmt.Sprintf("md5 mismatch (metadata: %s, sources: %s)", other, sum))
+	}
+	if len(errs) > 0 {
+		v.Failed++
+		slog.Error("verification failed", "file", m.Name, "reason", strings.Join(errs, ", "))
+	} else {
+		slog.Info("verification ok", "file", m.Name)
+	}
+}
+
+func (v *verifier) Err() error {
+	if v.Failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d/%d files failed verification", v.Failed, v.Files)
+}
+
+// digestFile computes the md5 of the (decompressed) content of a listing
+// file.
+func digestFile(file string) (string, int64, error) {
+	r, err := openSource(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	digest := md5.New()
+	n, err := io.Copy(digest, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil)), n, nil
+}
+
+func readSum(file string) (string, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	c := struct {
+		Sum string `xml:"md5"`
+	}{}
+	if err := xml.NewDecoder(r).Decode(&c); err != nil {
+		return "", fmt.Errorf("%s: %s", file, err)
+	}
+	return c.Sum, nil
+}
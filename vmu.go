@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// gpsEpoch is the origin of the times given by the VMU.
+var gpsEpoch = time.Date(1980, 1, 6, 0, 0, 0, 0, time.UTC)
+
+// vmuHeader is the secondary header written by the VMU (HRDL) after the
+// four-char code of the dat files. Its 12 bytes are made of:
+//
+//	origin   1 byte
+//	counter  4 bytes, unsigned, big endian
+//	coarse   4 bytes, seconds since the GPS epoch, big endian
+//	fine     1 byte, 1/256 of second
+//	spare    2 bytes
+type vmuHeader struct {
+	Origin  uint8
+	Counter uint32
+	Time    time.Time
+}
+
+// headerDecoder is implemented by the decoders able to decode the header
+// following the magic of the dat files.
+type headerDecoder interface {
+	Header(bs []byte) *vmuHeader
+}
+
+// decodeVMU decodes the VMU header bs. It is nil when bs is too short or
+// only made of zeros (header not filled).
+func decodeVMU(bs []byte) *vmuHeader {
+	if len(bs) < 10 {
+		return nil
+	}
+	var set bool
+	for _, b := range bs {
+		if b != 0 {
+			set = true
+			break
+		}
+	}
+	if !set {
+		return nil
+	}
+	coarse := binary.BigEndian.Uint32(bs[5:])
+	fine := time.Duration(bs[9]) * time.Second / 256
+	return &vmuHeader{
+		Origin:  bs[0],
+		Counter: binary.BigEndian.Uint32(bs[1:]),
+		Time:    gpsEpoch.Add(time.Duration(coarse)*time.Second + fine),
+	}
+}
+
+func (h *vmuHeader) String() string {
+	return fmt.Sprintf("origin 0x%02x, counter %d, time %s", h.Origin, h.Counter, h.Time.Format(time.RFC3339Nano))
+}
+
+func (mvisDecoder) Header(bs []byte) *vmuHeader {
+	return decodeVMU(bs)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sortPaths sorts the paths of dat files in the order they are processed:
+// lexicographic order of their names (channel, UPI, acquisition time and
+// version) and then of their paths (byte by byte). Since the blocks of the
+// files are then read in the order of the files, the same set of files always
+// gives the same listing files, whatever the order given by the file system
+// or the command line (e.g. the block kept among duplicates), and the files
+// of an archive split in multiple roots are taken in the order of their
+// acquisition.
+func sortPaths(ps []string) {
+	sort.SliceStable(ps, func(i, j int) bool {
+		if bi, bj := filepath.Base(ps[i]), filepath.Base(ps[j]); bi != bj {
+			return bi < bj
+		}
+		return ps[i] < ps[j]
+	})
+}
+
+// splitRoots gives the root directories of an archive given as a comma
+// separated list.
+func splitRoots(base string) []string {
+	var roots []string
+	for _, r := range strings.Split(base, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roots = append(roots, r)
+		}
+	}
+	return roots
+}
+
+// levels of the directories of the hadock archive
+// (channel/year/doy/hour/min).
+const (
+	levelNone = iota
+	levelYear
+	levelDay
+	levelHour
+	levelMinute
+)
+
+// channels restricts the walk of the archive to some channels (-channel).
+var channels []int
+
+// parseChannels parses a comma separated list of channels.
+func parseChannels(str string) ([]int, error) {
+	var cs []int
+	for _, c := range strings.Split(str, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid channel: %s", c)
+		}
+		cs = append(cs, n)
+	}
+	return cs, nil
+}
+
+// channelSelected reports whether the channel ch (given by the name of a
+// directory or a dat file) is part of channels. Everything is selected when
+// channels is empty or ch is not a channel.
+func channelSelected(ch string) bool {
+	n, err := strconv.Atoi(ch)
+	if err != nil || len(channels) == 0 {
+		return true
+	}
+	for _, c := range channels {
+		if c == n {
+			return true
+		}
+	}
+	return false
+}
+
+// walkArchive calls fn for each file found under dir. It follows the layout
+// of the hadock archive: directories whose period is outside the ranges of
+// dates of all the rules of set are not visited and neither are the
+// directories of the channels not selected (the directories directly under
+// dir that are not years). Entries are visited in lexical order without
+// calling stat on the files.
+func walkArchive(dir string, set []upiRule, fn func(string)) error {
+	return walkLevel(dir, time.Time{}, levelNone, set, fn)
+}
+
+func walkLevel(dir string, when time.Time, level int, set []upiRule, fn func(string)) error {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		p := filepath.Join(dir, e.Name())
+		if !e.IsDir() {
+			fn(p)
+			continue
+		}
+		from, to, next, ok := dirPeriod(e.Name(), when, level)
+		if ok && !inPeriod(set, from, to) {
+			continue
+		}
+		if !ok && level == levelNone && !channelSelected(e.Name()) {
+			continue
+		}
+		if err := walkLevel(p, from, next, set, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirPeriod gives the period covered by the directory name found under a
+// directory of the given level starting at when. ok is false when the
+// directory is not part of the dated tree of the archive.
+func dirPeriod(name string, when time.Time, level int) (time.Time, time.Time, int, bool) {
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 0 {
+		return when, when, level, false
+	}
+	switch {
+	case level == levelNone && len(name) == 4:
+		from := time.Date(n, 1, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(1, 0, 0), levelYear, true
+	case level == levelYear && n >= 1:
+		from := when.AddDate(0, 0, n-1)
+		return from, from.AddDate(0, 0, 1), levelDay, true
+	case level == levelDay && n < 24:
+		from := when.Add(time.Duration(n) * time.Hour)
+		return from, from.Add(time.Hour), levelHour, true
+	case level == levelHour && n < 60:
+		from := when.Add(time.Duration(n) * time.Minute)
+		return from, from.Add(time.Minute), levelMinute, true
+	default:
+		return when, when, level, false
+	}
+}
+
+// inPeriod reports whether one of the rules of set accepts files acquired
+// between from and to.
+func inPeriod(set []upiRule, from, to time.Time) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, u := range set {
+		if (u.From.IsZero() || to.After(u.From)) && (u.To.IsZero() || from.Before(u.To)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchReader reads the dat files of the archive that match a set of UPI.
+// Instead of returning io.EOF once all the files have been read, it scans
+// the archive again at regular interval for files not seen yet.
+type watchReader struct {
+	roots    []string
+	set      []upiRule
+	keep     bool
+	interval time.Duration
+
+	seen  map[string]struct{}
+	queue []string
+	file  *sourceFile
+	frame []byte
+	rest  []byte
+	// signals interrupting the wait for new dat files
+	signals <-chan os.Signal
+}
+
+func NewWatch(base, file string, keep bool, interval time.Duration) (*watchReader, error) {
+	roots := splitRoots(base)
+	if len(roots) == 0 {
+		return nil, errNoFiles
+	}
+	set, err := readSet(file)
+	if err != nil {
+		return nil, err
+	}
+	w := watchReader{
+		roots:    roots,
+		set:      set,
+		keep:     keep,
+		interval: interval,
+		seen:     make(map[string]struct{}),
+	}
+	return &w, nil
+}
+
+func (w *watchReader) Filename() string {
+	if w.file == nil {
+		return ""
+	}
+	return w.file.Name()
+}
+
+// ReadBlock gives the next block of the dat files, waiting for new ones once
+// all of them have been read. Fill blocks are dropped (unless -keep-fill is
+// set) and so are the incomplete blocks found at the end of a dat file. The
+// block is only valid until the next call.
+func (w *watchReader) ReadBlock() (Block, error) {
+	if len(w.frame) != LineSize {
+		w.frame = make([]byte, LineSize)
+	}
+	for {
+		for w.file == nil {
+			if len(w.queue) == 0 {
+				w.scan()
+			}
+			if len(w.queue) == 0 {
+				if err := w.wait(); err != nil {
+					return Block{}, err
+				}
+				continue
+			}
+			f, err := openFile(w.queue[0])
+			if err != nil {
+				slog.Error("invalid dat file", "file", w.queue[0], "err", err)
+			}
+			w.file, w.queue = f, w.queue[1:]
+		}
+		n, err := w.file.Read(w.frame)
+		if err == io.EOF {
+			w.file.Close()
+			w.file = nil
+			continue
+		}
+		if err != nil {
+			return Block{}, err
+		}
+		if n < LineSize {
+			slog.Warn("incomplete block dropped", "file", w.file.Name(), "bytes", n)
+			continue
+		}
+		b, _ := parseBlock(w.frame)
+		if b.IsFill() && !keepFill {
+			continue
+		}
+		return b, nil
+	}
+}
+
+// Read copies the blocks given by ReadBlock in bs.
+func (w *watchReader) Read(bs []byte) (int, error) {
+	if len(w.rest) == 0 {
+		b, err := w.ReadBlock()
+		if err != nil {
+			return 0, err
+		}
+		w.rest = b.Bytes()
+	}
+	n := copy(bs, w.rest)
+	w.rest = w.rest[n:]
+	return n, nil
+}
+
+// wait waits for the next scan of the archive. It gives errInterrupted
+// when a signal is received in the meantime.
+func (w *watchReader) wait() error {
+	t := time.NewTimer(w.interval)
+	defer t.Stop()
+	select {
+	case <-w.signals:
+		return errInterrupted
+	case <-t.C:
+		return nil
+	}
+}
+
+func (w *watchReader) scan() {
+	for _, r := range w.roots {
+		for p := range listFiles(r, w.set) {
+			// files still written are read once finalized
+			if isRolling(p) {
+				continue
+			}
+			if _, ok := w.seen[p]; ok {
+				continue
+			}
+			w.seen[p] = struct{}{}
+			if !w.keep && strings.HasSuffix(p, ".bad") {
+				continue
+			}
+			w.queue = append(w.queue, p)
+		}
+	}
+	sortPaths(w.queue)
+}
+
+func (w *watchReader) UPIs() ([]string, bool) {
+	return upiNames(w.set), true
+}